@@ -12,10 +12,11 @@ type AdsSettings struct {
 }
 
 func getAdsSettings(w http.ResponseWriter, r *http.Request) {
+	config := channelSettings(channelIdFromRequest(r))
 	settings := AdsSettings{
-		Src:    settingConfig.AdSrc,
-		Width:  settingConfig.AdWidth,
-		Margin: settingConfig.AdMargin,
+		Src:    config.AdSrc,
+		Width:  config.AdWidth,
+		Margin: config.AdMargin,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/redis/go-redis/v9"
+)
+
+// Views and reactions of a message are counted in message:{id}:analytics,
+// in fields named "{h|d}:{bucket start}:views" and "{h|d}:{bucket start}:r:{emoji}"
+// for hourly and daily buckets. Hourly buckets older than
+// AnalyticsHourlyDays are rolled up into daily ones by the rollup job.
+// Messages that still have hourly buckets are listed in analytics:hourly.
+
+const (
+	analyticsRollupInterval = time.Hour
+	analyticsViewsMilestone = 100
+)
+
+type AnalyticsBucket struct {
+	Time      time.Time        `json:"time"`
+	Views     int64            `json:"views"`
+	Reactions map[string]int64 `json:"reactions"`
+}
+
+type MessageAnalytics struct {
+	MessageID     int               `json:"messageId"`
+	Views         int64             `json:"views"`
+	UniqueViewers int64             `json:"uniqueViewers"`
+	Reactions     Reactions         `json:"reactions"`
+	TimeTo100     *int64            `json:"timeToFirst100Views,omitempty"`
+	Hourly        []AnalyticsBucket `json:"hourly"`
+	Daily         []AnalyticsBucket `json:"daily"`
+}
+
+func analyticsKey(messageId int) string {
+	return fmt.Sprintf("message:%d:analytics", messageId)
+}
+
+func hourBucket(t time.Time) int64 {
+	return t.UTC().Truncate(time.Hour).Unix()
+}
+
+func dayBucket(t time.Time) int64 {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix()
+}
+
+// recordViewStats counts a view in the current hour. views is the lifetime
+// count after this view, used to note when the message reached 100 views.
+func recordViewStats(ctx context.Context, messageId int, views int64) {
+	now := time.Now()
+	key := analyticsKey(messageId)
+
+	pipe := rdb.Pipeline()
+	pipe.HIncrBy(ctx, key, fmt.Sprintf("h:%d:views", hourBucket(now)), 1)
+	if views == analyticsViewsMilestone {
+		pipe.HSetNX(ctx, key, "views_100_at", now.Unix())
+	}
+	pipe.ZAdd(ctx, "analytics:hourly", redis.Z{Score: float64(now.Unix()), Member: messageId})
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record view of message %d: %v\n", messageId, err)
+	}
+}
+
+// recordReactionStats counts a change of a user's reaction in the current
+// hour: the previous emoji is taken off and the new one, if any, added.
+func recordReactionStats(ctx context.Context, messageId int, prevEmoji, emoji string) {
+	if prevEmoji == emoji {
+		return
+	}
+
+	now := time.Now()
+	key := analyticsKey(messageId)
+	hour := hourBucket(now)
+
+	pipe := rdb.Pipeline()
+	if prevEmoji != "" {
+		pipe.HIncrBy(ctx, key, fmt.Sprintf("h:%d:r:%s", hour, prevEmoji), -1)
+	}
+	if emoji != "" {
+		pipe.HIncrBy(ctx, key, fmt.Sprintf("h:%d:r:%s", hour, emoji), 1)
+	}
+	pipe.ZAdd(ctx, "analytics:hourly", redis.Z{Score: float64(now.Unix()), Member: messageId})
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record reaction of message %d: %v\n", messageId, err)
+	}
+}
+
+func runAnalyticsRollupJob() {
+	ticker := time.NewTicker(analyticsRollupInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := rollupAnalytics(); err != nil {
+			log.Printf("Failed to roll up message analytics: %v\n", err)
+		}
+		<-ticker.C
+	}
+}
+
+func rollupAnalytics() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	cutoff := hourBucket(time.Now().AddDate(0, 0, -int(settingConfig.AnalyticsHourlyDays)))
+
+	// Messages without activity since the cutoff only have old buckets left
+	members, err := rdb.ZRange(ctx, "analytics:hourly", 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		messageId, err := strconv.Atoi(member)
+		if err != nil {
+			rdb.ZRem(ctx, "analytics:hourly", member)
+			continue
+		}
+
+		remaining, err := rollupMessageAnalytics(ctx, messageId, cutoff)
+		if err != nil {
+			log.Printf("Failed to roll up analytics of message %d: %v\n", messageId, err)
+			continue
+		}
+
+		if remaining == 0 {
+			rdb.ZRem(ctx, "analytics:hourly", member)
+		}
+	}
+
+	return nil
+}
+
+// rollupMessageAnalytics moves the hourly buckets before cutoff into daily
+// buckets and returns the number of hourly buckets left.
+func rollupMessageAnalytics(ctx context.Context, messageId int, cutoff int64) (int, error) {
+	key := analyticsKey(messageId)
+
+	fields, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := 0
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for field, value := range fields {
+			parts := strings.SplitN(field, ":", 3)
+			if len(parts) != 3 || parts[0] != "h" {
+				continue
+			}
+
+			hour, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			if hour >= cutoff {
+				remaining++
+				continue
+			}
+
+			count, _ := strconv.ParseInt(value, 10, 64)
+			day := dayBucket(time.Unix(hour, 0))
+			pipe.HIncrBy(ctx, key, fmt.Sprintf("d:%d:%s", day, parts[2]), count)
+			pipe.HDel(ctx, key, field)
+		}
+		return nil
+	})
+
+	return remaining, err
+}
+
+func dbGetMessageAnalytics(ctx context.Context, messageId int) (MessageAnalytics, error) {
+	analytics := MessageAnalytics{
+		MessageID: messageId,
+		Hourly:    []AnalyticsBucket{},
+		Daily:     []AnalyticsBucket{},
+	}
+
+	values, err := rdb.HMGet(ctx, fmt.Sprintf("messages:%d", messageId), "views", "reactions", "timestamp").Result()
+	if err != nil {
+		return analytics, err
+	}
+
+	viewsStr, _ := values[0].(string)
+	analytics.Views, _ = strconv.ParseInt(viewsStr, 10, 64)
+
+	if reactionsStr, _ := values[1].(string); reactionsStr != "" {
+		json.Unmarshal([]byte(reactionsStr), &analytics.Reactions)
+	}
+
+	timestampStr, _ := values[2].(string)
+	timestamp, _ := time.Parse(time.RFC3339, timestampStr)
+
+	analytics.UniqueViewers, err = rdb.SCard(ctx, fmt.Sprintf("message:%d:viewed_by", messageId)).Result()
+	if err != nil {
+		return analytics, err
+	}
+
+	fields, err := rdb.HGetAll(ctx, analyticsKey(messageId)).Result()
+	if err != nil {
+		return analytics, err
+	}
+
+	hourly := make(map[int64]*AnalyticsBucket)
+	daily := make(map[int64]*AnalyticsBucket)
+
+	for field, value := range fields {
+		count, _ := strconv.ParseInt(value, 10, 64)
+
+		if field == "views_100_at" {
+			if !timestamp.IsZero() {
+				seconds := count - timestamp.Unix()
+				analytics.TimeTo100 = &seconds
+			}
+			continue
+		}
+
+		parts := strings.SplitN(field, ":", 4)
+		if len(parts) < 3 {
+			continue
+		}
+
+		start, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		buckets := hourly
+		if parts[0] == "d" {
+			buckets = daily
+		} else if parts[0] != "h" {
+			continue
+		}
+
+		bucket, ok := buckets[start]
+		if !ok {
+			bucket = &AnalyticsBucket{Time: time.Unix(start, 0).UTC(), Reactions: map[string]int64{}}
+			buckets[start] = bucket
+		}
+
+		switch {
+		case parts[2] == "views":
+			bucket.Views += count
+		case parts[2] == "r" && len(parts) == 4:
+			bucket.Reactions[parts[3]] += count
+		}
+	}
+
+	analytics.Hourly = sortedBuckets(hourly)
+	analytics.Daily = sortedBuckets(daily)
+
+	return analytics, nil
+}
+
+func sortedBuckets(buckets map[int64]*AnalyticsBucket) []AnalyticsBucket {
+	result := make([]AnalyticsBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		result = append(result, *bucket)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+
+	return result
+}
+
+func getMessageAnalytics(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || !messageInChannel(ctx, r, id) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	analytics, err := dbGetMessageAnalytics(ctx, id)
+	if err != nil {
+		log.Printf("Failed to get analytics of message %d: %v\n", id, err)
+		http.Error(w, "Failed to get message analytics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analytics)
+}
@@ -3,15 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/h2non/filetype"
+	"github.com/redis/go-redis/v9"
 	"github.com/subosito/gozaru"
 	"gopkg.in/yaml.v3"
 )
@@ -31,19 +34,33 @@ func getVersion(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(versionInfo)
 }
 
+func dbGetMessageIdByExternalId(ctx context.Context, channelId int, externalId string) (int, error) {
+	id, err := rdb.Get(ctx, externalIdKey(channelId, externalId)).Int()
+	if err != nil {
+		return 0, err
+	}
+
+	exists, err := rdb.Exists(ctx, fmt.Sprintf("messages:%d", id)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if exists == 0 {
+		return 0, redis.Nil
+	}
+
+	return id, nil
+}
+
 func addNewPost(w http.ResponseWriter, r *http.Request) {
-	key := r.Header.Get("X-API-Key")
-	if key != settingConfig.ApiSecretKey {
-		http.Error(w, "error", http.StatusBadRequest)
+	key, ok := authenticateApiKey(w, r, ScopePost)
+	if !ok {
 		return
 	}
 
-	var message Message
-	var err error
 	defer r.Body.Close()
 
 	body := Message{}
-	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		log.Printf("Failed to decode message: %v\n", err)
 		http.Error(w, "error", http.StatusBadRequest)
 		return
@@ -52,42 +69,34 @@ func addNewPost(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if settingConfig.MessageSignature != "" {
-		body.Text = body.Text + "\n\n---\n" + settingConfig.MessageSignature
-	}
-
-	message.ID = getMessageNextId(ctx)
-	message.Type = "md" //body.Type
-	message.Author = body.Author
-	// Use provided timestamp or current time if not provided
-	if body.Timestamp.IsZero() {
-		message.Timestamp = time.Now()
-	} else {
-		message.Timestamp = body.Timestamp
-	}
-	message.Text = body.Text
-	message.Views = 0
-	message.ReplyTo = body.ReplyTo
-	message.IsThread = body.IsThread
+	post, err := createPost(ctx, apiNewPost(r, key, body))
+	writeCreatedPost(w, post, err)
+}
 
-	if err = setMessage(ctx, message, false); err != nil {
-		log.Printf("Failed to set new message: %v\n", err)
-		http.Error(w, "error", http.StatusInternalServerError)
-		return
+// apiNewPost builds the post of an API request. The timestamp of the body
+// is kept, so imported posts keep their original time.
+func apiNewPost(r *http.Request, key *ApiKey, body Message) NewPost {
+	return NewPost{
+		ChannelId:  channelIdFromRequest(r),
+		Source:     PostSourceApi,
+		Author:     apiKeyAuthor(key, body.Author),
+		Type:       "md",
+		Text:       body.Text,
+		ReplyTo:    body.ReplyTo,
+		IsThread:   body.IsThread,
+		Timestamp:  body.Timestamp,
+		ExternalId: body.ExternalId,
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(message)
 }
 
 func addNewPostWithFiles(w http.ResponseWriter, r *http.Request) {
-	key := r.Header.Get("X-API-Key")
-	if key != settingConfig.ApiSecretKey {
-		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+	key, ok := authenticateApiKey(w, r, ScopePostWithFiles)
+	if !ok {
 		return
 	}
 
-	if !settingConfig.AllowApiFileUpload {
+	config := channelSettings(channelIdFromRequest(r))
+	if !config.AllowApiFileUpload {
 		http.Error(w, "File upload via API is not enabled", http.StatusForbidden)
 		return
 	}
@@ -98,7 +107,7 @@ func addNewPostWithFiles(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 
 	// Parse multipart form
-	maxSize := int64(settingConfig.ApiMaxFileSizePerFile * settingConfig.ApiMaxFilesPerMessage << 20)
+	maxSize := int64(config.ApiMaxFileSizePerFile * config.ApiMaxFilesPerMessage << 20)
 	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
 
 	if err := r.ParseMultipartForm(maxSize); err != nil {
@@ -121,12 +130,18 @@ func addNewPostWithFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Checked again when the post is created, but before the files are saved
+	if body.ExternalId != "" && externalIdTaken(ctx, channelIdFromRequest(r), body.ExternalId) {
+		http.Error(w, "External id already exists", http.StatusConflict)
+		return
+	}
+
 	// Handle file uploads
 	var files []FileResponse
 	form := r.MultipartForm
 	if form != nil && form.File != nil {
 		uploadedFiles := form.File["files"]
-		if len(uploadedFiles) > int(settingConfig.ApiMaxFilesPerMessage) {
+		if len(uploadedFiles) > int(config.ApiMaxFilesPerMessage) {
 			http.Error(w, "too many files", http.StatusBadRequest)
 			return
 		}
@@ -138,7 +153,7 @@ func addNewPostWithFiles(w http.ResponseWriter, r *http.Request) {
 
 		for _, fileHeader := range uploadedFiles {
 			// Check file size
-			if fileHeader.Size > int64(settingConfig.ApiMaxFileSizePerFile<<20) {
+			if fileHeader.Size > int64(config.ApiMaxFileSizePerFile<<20) {
 				http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
 				return
 			}
@@ -166,58 +181,201 @@ func addNewPostWithFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Add signature if configured
-	if settingConfig.MessageSignature != "" {
-		body.Text = body.Text + "\n\n---\n" + settingConfig.MessageSignature
-	}
+	newPost := apiNewPost(r, key, body)
+	newPost.Files = files
 
-	// Create message
-	var message Message
-	message.ID = getMessageNextId(ctx)
-	message.Type = "md"
-	message.Author = body.Author
-	// Use provided timestamp or current time if not provided
-	if body.Timestamp.IsZero() {
-		message.Timestamp = time.Now()
-	} else {
-		message.Timestamp = body.Timestamp
-	}
-	message.Text = body.Text
-	message.Views = 0
-	message.ReplyTo = body.ReplyTo
-	message.IsThread = body.IsThread
-
-	// Embed files in message text (like regular file uploads)
-	if len(files) > 0 {
-		for _, file := range files {
-			var embedded string
-			if file.FileType == "image" {
-				embedded = "[image-embedded#](" + file.URL + ")"
-			} else if file.FileType == "video" {
-				embedded = "[video-embedded#](" + file.URL + ")"
-			} else if file.FileType == "audio" {
-				embedded = "[audio-embedded#](" + file.URL + ")"
-			} else {
-				embedded = "[" + file.Filename + "](" + file.URL + ")"
-			}
+	post, err := createPost(ctx, newPost)
+	writeCreatedPost(w, post, err)
+}
 
-			if message.Text != "" {
-				message.Text += "\n"
-			}
-			message.Text += embedded
+// apiMessageRef identifies a message in the external API requests, either
+// by its id or by the external id it was created with.
+type apiMessageRef struct {
+	ID         int    `json:"id"`
+	ExternalId string `json:"externalId"`
+}
+
+// resolveApiMessage returns the data of a message the API may change: a
+// message of the request's channel that was not posted by a signed in user.
+func resolveApiMessage(ctx context.Context, r *http.Request, ref apiMessageRef) (int, map[string]string, bool) {
+	id := ref.ID
+	if ref.ExternalId != "" {
+		var err error
+		if id, err = dbGetMessageIdByExternalId(ctx, channelIdFromRequest(r), ref.ExternalId); err != nil {
+			return 0, nil, false
 		}
 	}
 
-	if err := setMessage(ctx, message, false); err != nil {
-		log.Printf("Failed to set new message: %v\n", err)
+	if id <= 0 || !messageInChannel(ctx, r, id) {
+		return 0, nil, false
+	}
+
+	data, err := rdb.HGetAll(ctx, fmt.Sprintf("messages:%d", id)).Result()
+	if err != nil || data["authorId"] != "" {
+		return 0, nil, false
+	}
+
+	return id, data, true
+}
+
+func getApiPost(w http.ResponseWriter, r *http.Request) {
+	_, ok := authenticateApiKey(w, r, ScopeRead)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+	ref := apiMessageRef{ID: id, ExternalId: r.URL.Query().Get("externalId")}
+
+	_, data, ok := resolveApiMessage(ctx, r, ref)
+	if !ok {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	message, err := parseMessageFromRedis(data, true, true, true)
+	if err != nil {
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
+	message.ExternalId = data["external_id"]
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(message)
 }
 
+func updateApiPost(w http.ResponseWriter, r *http.Request) {
+	key, ok := authenticateApiKey(w, r, ScopeEdit)
+	if !ok {
+		return
+	}
+
+	defer r.Body.Close()
+
+	var req struct {
+		apiMessageRef
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Text == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, data, ok := resolveApiMessage(ctx, r, req.apiMessageRef)
+	if !ok || data["deleted"] == "1" {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	if err := dbAddMessageRevision(ctx, id, newMessageRevision(data, Session{ID: "api:" + key.Id, PublicName: key.Name})); err != nil {
+		log.Printf("Failed to save revision of message %d: %v\n", id, err)
+		http.Error(w, "Failed to save message revision", http.StatusInternalServerError)
+		return
+	}
+
+	text := req.Text
+	if signature := channelSettings(channelIdFromData(data)).MessageSignature; signature != "" {
+		text = text + "\n\n---\n" + signature
+	}
+
+	// Only the edited fields are written, counters like the views keep
+	// changing while the edit is in progress
+	messageKey := fmt.Sprintf("messages:%d", id)
+	if err := rdb.HSet(ctx, messageKey, "text", text, "last_edit", time.Now()).Err(); err != nil {
+		log.Printf("Failed to update message %d: %v\n", id, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := dbReindexMessageTags(ctx, id); err != nil {
+		log.Printf("Failed to reindex tags of message %d: %v\n", id, err)
+	}
+
+	data, err := rdb.HGetAll(ctx, messageKey).Result()
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	message, err := parseMessageFromRedis(data, true, true, true)
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	// Fields the parser hides by the channel settings are returned as stored
+	message.Views, _ = strconv.Atoi(data["views"])
+	message.ExternalId = data["external_id"]
+
+	publishEvent(ctx, "edit-message", message)
+	go SendWebhook(context.Background(), "update", message)
+	go updateLinkPreviews(message.ID, message.ChannelId, message.Text)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(message)
+}
+
+func deleteApiPost(w http.ResponseWriter, r *http.Request) {
+	_, ok := authenticateApiKey(w, r, ScopeDelete)
+	if !ok {
+		return
+	}
+
+	defer r.Body.Close()
+
+	var ref apiMessageRef
+	if err := json.NewDecoder(r.Body).Decode(&ref); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, data, ok := resolveApiMessage(ctx, r, ref)
+	if !ok || data["deleted"] == "1" {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	if err := funcDeleteMessage(ctx, strconv.Itoa(id)); err != nil {
+		log.Printf("Failed to delete message %d: %v\n", id, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	go SendWebhook(context.Background(), "delete", Message{ID: id, Deleted: true, ExternalId: data["external_id"]})
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// embedFileInText appends the markdown that embeds an uploaded file to a message text.
+func embedFileInText(text string, file FileResponse) string {
+	var embedded string
+	if file.FileType == "image" {
+		embedded = "[image-embedded#](" + file.URL + ")"
+	} else if file.FileType == "video" {
+		embedded = "[video-embedded#](" + file.URL + ")"
+	} else if file.FileType == "audio" {
+		embedded = "[audio-embedded#](" + file.URL + ")"
+	} else {
+		embedded = "[" + file.Filename + "](" + file.URL + ")"
+	}
+
+	if text != "" {
+		text += "\n"
+	}
+	return text + embedded
+}
+
 func processAndSaveFile(file multipart.File, fileHeader *multipart.FileHeader) (FileResponse, error) {
 	// Create upload directory if not exists
 	if err := os.MkdirAll(rootUploadPath, os.ModePerm); err != nil {
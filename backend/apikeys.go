@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// API keys are sent as "{id}.{secret}" in the X-API-Key header. The record
+// in api_key:{id} keeps only the SHA-256 of the secret, and the last use is
+// tracked apart in api_key:{id}:usage so requests don't rewrite the record.
+// A key is bound to the channel it was created in; the key migrated from
+// the single api_secret_key setting has no channel and no id in the header.
+
+type ApiScope string
+
+const (
+	ScopePost          ApiScope = "post"
+	ScopePostWithFiles ApiScope = "post-with-files"
+	ScopeEdit          ApiScope = "edit"
+	ScopeDelete        ApiScope = "delete"
+	ScopeRead          ApiScope = "read"
+)
+
+var apiScopes = []ApiScope{ScopePost, ScopePostWithFiles, ScopeEdit, ScopeDelete, ScopeRead}
+
+const legacyApiKeyId = "legacy"
+
+type ApiKey struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Author     string     `json:"author"`
+	Scopes     []ApiScope `json:"scopes"`
+	ChannelId  int        `json:"channelId,omitempty"`
+	Hash       string     `json:"hash,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	CreatedBy  string     `json:"createdBy,omitempty"`
+	ExpiresAt  time.Time  `json:"expiresAt,omitzero"`
+	RevokedAt  time.Time  `json:"revokedAt,omitzero"`
+	RevokedBy  string     `json:"revokedBy,omitempty"`
+	LastUsedAt time.Time  `json:"lastUsedAt,omitzero"`
+	LastUsedIP string     `json:"lastUsedIp,omitempty"`
+}
+
+var (
+	errInvalidApiKey = errors.New("invalid API key")
+	errApiKeyScope   = errors.New("API key lacks the required scope")
+)
+
+func apiKeyRecordKey(id string) string { return fmt.Sprintf("api_key:%s", id) }
+
+func apiKeyUsageKey(id string) string { return fmt.Sprintf("api_key:%s:usage", id) }
+
+func hashApiSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (k *ApiKey) HasScope(scope ApiScope) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+func (k *ApiKey) Active() bool {
+	return k.RevokedAt.IsZero() && (k.ExpiresAt.IsZero() || time.Now().Before(k.ExpiresAt))
+}
+
+func dbSaveApiKey(ctx context.Context, key ApiKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal api key: %v", err)
+	}
+
+	if err := rdb.Set(ctx, apiKeyRecordKey(key.Id), data, 0).Err(); err != nil {
+		return err
+	}
+
+	return rdb.SAdd(ctx, "api_keys:list", key.Id).Err()
+}
+
+func dbGetApiKey(ctx context.Context, id string) (ApiKey, error) {
+	var key ApiKey
+
+	data, err := rdb.Get(ctx, apiKeyRecordKey(id)).Result()
+	if err != nil {
+		return key, err
+	}
+
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return key, fmt.Errorf("failed to unmarshal api key: %v", err)
+	}
+
+	usage, err := rdb.HGetAll(ctx, apiKeyUsageKey(id)).Result()
+	if err == nil {
+		key.LastUsedAt, _ = time.Parse(time.RFC3339, usage["at"])
+		key.LastUsedIP = usage["ip"]
+	}
+
+	return key, nil
+}
+
+// dbCreateApiKey stores a new key and returns it with the plain key, which
+// is not stored and can't be shown again.
+func dbCreateApiKey(ctx context.Context, key ApiKey) (ApiKey, string, error) {
+	key.Id = generatedRandomID(8)
+	secret := generatedRandomID(32)
+	if key.Id == "" || secret == "" {
+		return key, "", errors.New("failed to generate api key")
+	}
+
+	key.Hash = hashApiSecret(secret)
+	key.CreatedAt = time.Now()
+
+	if err := dbSaveApiKey(ctx, key); err != nil {
+		return key, "", err
+	}
+
+	return key, key.Id + "." + secret, nil
+}
+
+func dbGetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	ids, err := rdb.SMembers(ctx, "api_keys:list").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []ApiKey{}
+	for _, id := range ids {
+		key, err := dbGetApiKey(ctx, id)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	slices.SortFunc(keys, func(a, b ApiKey) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	return keys, nil
+}
+
+// apiKeyFromRequest finds the active key of the X-API-Key header that may be
+// used in the request's channel.
+func apiKeyFromRequest(ctx context.Context, r *http.Request) (*ApiKey, error) {
+	presented := r.Header.Get("X-API-Key")
+	if presented == "" {
+		return nil, errInvalidApiKey
+	}
+
+	id, secret, found := strings.Cut(presented, ".")
+	if !found {
+		id, secret = legacyApiKeyId, presented
+	}
+
+	key, err := dbGetApiKey(ctx, id)
+	if err == redis.Nil && found {
+		// The legacy secret may contain a dot itself
+		id, secret = legacyApiKeyId, presented
+		key, err = dbGetApiKey(ctx, id)
+	}
+	if err != nil {
+		return nil, errInvalidApiKey
+	}
+
+	hash := hashApiSecret(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) != 1 {
+		return nil, errInvalidApiKey
+	}
+
+	if !key.Active() {
+		return nil, errInvalidApiKey
+	}
+
+	if key.ChannelId != 0 && key.ChannelId != channelIdFromRequest(r) {
+		return nil, errInvalidApiKey
+	}
+
+	return &key, nil
+}
+
+// authenticateApiKey checks the key of the request for a scope and records
+// its use. On failure it writes the error response.
+func authenticateApiKey(w http.ResponseWriter, r *http.Request, scope ApiScope) (*ApiKey, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key, err := apiKeyFromRequest(ctx, r)
+	if err != nil {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if !key.HasScope(scope) {
+		http.Error(w, errApiKeyScope.Error(), http.StatusForbidden)
+		return nil, false
+	}
+
+	if err := rdb.HSet(ctx, apiKeyUsageKey(key.Id), "at", time.Now().Format(time.RFC3339), "ip", clientIP(r)).Err(); err != nil {
+		log.Printf("Failed to record use of api key %s: %v\n", key.Id, err)
+	}
+
+	return key, true
+}
+
+// clientIP returns the address a request came from. X-Forwarded-For is only
+// believed when the request comes through one of the trusted proxies, and
+// then the client is the last address in it that isn't one of them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !trustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+		if !trustedProxy(ip) {
+			return ip
+		}
+		host = ip
+	}
+	return host
+}
+
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range settingConfig.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyAuthor returns the author a post of the key is published as. The
+// legacy key keeps taking it from the request.
+func apiKeyAuthor(key *ApiKey, requested string) string {
+	if key.Author != "" {
+		return key.Author
+	}
+	return requested
+}
+
+func validApiScopes(scopes []ApiScope) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(apiScopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeApiKeys drops the secret hashes before keys are sent to admins.
+func sanitizeApiKeys(keys []ApiKey) []ApiKey {
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	return keys
+}
+
+type CreatedApiKey struct {
+	Key    string `json:"key"`
+	ApiKey ApiKey `json:"apiKey"`
+}
+
+func getApiKeys(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	keys, err := dbGetApiKeys(ctx)
+	if err != nil {
+		log.Printf("Failed to get api keys: %v\n", err)
+		http.Error(w, "Failed to get api keys", http.StatusInternalServerError)
+		return
+	}
+
+	// Keys of other channels are left out; the legacy key works in all
+	channelId := channelIdFromRequest(r)
+	filtered := []ApiKey{}
+	for _, key := range keys {
+		if key.ChannelId == 0 || key.ChannelId == channelId {
+			filtered = append(filtered, key)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sanitizeApiKeys(filtered))
+}
+
+func createApiKey(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	var req struct {
+		Name      string     `json:"name"`
+		Author    string     `json:"author"`
+		Scopes    []ApiScope `json:"scopes"`
+		ExpiresAt time.Time  `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" || req.Author == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if !validApiScopes(req.Scopes) {
+		http.Error(w, "Invalid scopes", http.StatusBadRequest)
+		return
+	}
+
+	if !req.ExpiresAt.IsZero() && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	key, plain, err := dbCreateApiKey(ctx, ApiKey{
+		Name:      req.Name,
+		Author:    req.Author,
+		Scopes:    req.Scopes,
+		ChannelId: channelIdFromRequest(r),
+		CreatedBy: user.Email,
+		ExpiresAt: req.ExpiresAt,
+	})
+	if err != nil {
+		log.Printf("Failed to create api key: %v\n", err)
+		http.Error(w, "Failed to create api key", http.StatusInternalServerError)
+		return
+	}
+
+	key.Hash = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CreatedApiKey{Key: plain, ApiKey: key})
+}
+
+// loadManagedApiKey returns an active key the request's channel manages.
+func loadManagedApiKey(ctx context.Context, w http.ResponseWriter, r *http.Request, id string) (ApiKey, bool) {
+	key, err := dbGetApiKey(ctx, id)
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Failed to get api key %s: %v\n", id, err)
+		}
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return key, false
+	}
+
+	if key.ChannelId != 0 && key.ChannelId != channelIdFromRequest(r) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return key, false
+	}
+
+	if !key.RevokedAt.IsZero() {
+		http.Error(w, "API key is already revoked", http.StatusConflict)
+		return key, false
+	}
+
+	return key, true
+}
+
+func revokeApiKey(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	var req struct {
+		Id string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	key, ok := loadManagedApiKey(ctx, w, r, req.Id)
+	if !ok {
+		return
+	}
+
+	key.RevokedAt = time.Now()
+	key.RevokedBy = user.Email
+	if err := dbSaveApiKey(ctx, key); err != nil {
+		http.Error(w, "Failed to revoke api key", http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// rotateApiKey replaces a key with a new one of the same name, author,
+// scopes and expiry, and revokes the old key.
+func rotateApiKey(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	var req struct {
+		Id string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	old, ok := loadManagedApiKey(ctx, w, r, req.Id)
+	if !ok {
+		return
+	}
+
+	// The legacy key was usable in every channel, its replacement is bound
+	// to the channel it is rotated in like any new key
+	key, plain, err := dbCreateApiKey(ctx, ApiKey{
+		Name:      old.Name,
+		Author:    old.Author,
+		Scopes:    old.Scopes,
+		ChannelId: channelIdFromRequest(r),
+		CreatedBy: user.Email,
+		ExpiresAt: old.ExpiresAt,
+	})
+	if err != nil {
+		log.Printf("Failed to rotate api key %s: %v\n", old.Id, err)
+		http.Error(w, "Failed to rotate api key", http.StatusInternalServerError)
+		return
+	}
+
+	old.RevokedAt = time.Now()
+	old.RevokedBy = user.Email
+	if err := dbSaveApiKey(ctx, old); err != nil {
+		log.Printf("Failed to revoke rotated api key %s: %v\n", old.Id, err)
+	}
+
+	key.Hash = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CreatedApiKey{Key: plain, ApiKey: key})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With require_approval, posts of writers who aren't moderators of the
+// channel and posts of API clients wait in pending:list:{channelId} until a
+// moderator reviews them. Each submission is kept in pending:{id}, indexed
+// per author in pending:author:{userId}, and expires a while after review.
+
+const (
+	PendingStatusPending  = "pending"
+	PendingStatusApproved = "approved"
+	PendingStatusRejected = "rejected"
+
+	pendingReviewedTTL = 30 * 24 * time.Hour
+)
+
+type PendingMessage struct {
+	Message      Message   `json:"message"`
+	Status       string    `json:"status"`
+	Source       string    `json:"source"`
+	SubmittedAt  time.Time `json:"submittedAt"`
+	ReviewedBy   string    `json:"reviewedBy,omitempty"`
+	ReviewedAt   time.Time `json:"reviewedAt,omitzero"`
+	RejectReason string    `json:"rejectReason,omitempty"`
+}
+
+func pendingKey(messageId int) string { return fmt.Sprintf("pending:%d", messageId) }
+
+func pendingListKey(channelId int) string { return fmt.Sprintf("pending:list:%d", channelId) }
+
+func pendingAuthorKey(userId string) string { return fmt.Sprintf("pending:author:%s", userId) }
+
+// requiresApproval reports whether a post to the channel has to be reviewed.
+// Moderators, and admins through them, publish directly.
+func requiresApproval(channelId int, user *Session) bool {
+	if !channelSettings(channelId).RequireApproval {
+		return false
+	}
+	return user == nil || !(user.Privileges[Admin] || user.HasPrivilege(channelId, Moderator))
+}
+
+func dbSavePendingMessage(ctx context.Context, p PendingMessage) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending message: %v", err)
+	}
+
+	var ttl time.Duration
+	if p.Status != PendingStatusPending {
+		ttl = pendingReviewedTTL
+	}
+
+	return rdb.Set(ctx, pendingKey(p.Message.ID), data, ttl).Err()
+}
+
+func dbSubmitPendingMessage(ctx context.Context, m Message, source string) (PendingMessage, error) {
+	p := PendingMessage{
+		Message:     m,
+		Status:      PendingStatusPending,
+		Source:      source,
+		SubmittedAt: time.Now(),
+	}
+
+	if err := dbSavePendingMessage(ctx, p); err != nil {
+		return p, err
+	}
+
+	score := float64(p.SubmittedAt.Unix())
+	if err := rdb.ZAdd(ctx, pendingListKey(m.ChannelId), redis.Z{Score: score, Member: m.ID}).Err(); err != nil {
+		return p, err
+	}
+
+	if m.AuthorId != "" {
+		if err := rdb.ZAdd(ctx, pendingAuthorKey(m.AuthorId), redis.Z{Score: score, Member: m.ID}).Err(); err != nil {
+			return p, err
+		}
+	}
+
+	return p, nil
+}
+
+func dbGetPendingMessage(ctx context.Context, messageId int) (PendingMessage, error) {
+	var p PendingMessage
+
+	data, err := rdb.Get(ctx, pendingKey(messageId)).Result()
+	if err != nil {
+		return p, err
+	}
+
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return p, fmt.Errorf("failed to unmarshal pending message: %v", err)
+	}
+
+	return p, nil
+}
+
+// dbGetPendingMessages returns the submissions listed in a sorted set,
+// oldest first, dropping the ids whose submission has expired.
+func dbGetPendingMessages(ctx context.Context, listKey string) ([]PendingMessage, error) {
+	ids, err := rdb.ZRange(ctx, listKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	submissions := []PendingMessage{}
+	if len(ids) == 0 {
+		return submissions, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = "pending:" + id
+	}
+
+	values, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			rdb.ZRem(ctx, listKey, ids[i])
+			continue
+		}
+
+		var p PendingMessage
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			continue
+		}
+		submissions = append(submissions, p)
+	}
+
+	return submissions, nil
+}
+
+func getPendingMessages(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	submissions, err := dbGetPendingMessages(ctx, pendingListKey(channelIdFromRequest(r)))
+	if err != nil {
+		log.Printf("Failed to get pending messages: %v\n", err)
+		http.Error(w, "Failed to get pending messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(submissions)
+}
+
+// getMySubmissions lists the posts the user submitted for approval in the
+// channel, with their review status.
+func getMySubmissions(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	submissions, err := dbGetPendingMessages(ctx, pendingAuthorKey(user.ID))
+	if err != nil {
+		log.Printf("Failed to get submissions: %v\n", err)
+		http.Error(w, "Failed to get submissions", http.StatusInternalServerError)
+		return
+	}
+
+	channelId := channelIdFromRequest(r)
+	filtered := []PendingMessage{}
+	for _, p := range submissions {
+		if p.Message.ChannelId == channelId {
+			filtered = append(filtered, p)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filtered)
+}
+
+// loadPendingForReview returns a submission of the request's channel that
+// still waits for review.
+func loadPendingForReview(ctx context.Context, w http.ResponseWriter, r *http.Request, messageId int) (PendingMessage, bool) {
+	p, err := dbGetPendingMessage(ctx, messageId)
+	if err != nil || p.Message.ChannelId != channelIdFromRequest(r) {
+		http.Error(w, "Pending message not found", http.StatusNotFound)
+		return p, false
+	}
+
+	if p.Status != PendingStatusPending {
+		http.Error(w, "Message was already reviewed", http.StatusConflict)
+		return p, false
+	}
+
+	return p, true
+}
+
+func editPendingMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var req struct {
+		ID   int    `json:"id"`
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	p, ok := loadPendingForReview(ctx, w, r, req.ID)
+	if !ok {
+		return
+	}
+
+	if req.Type != "" && p.Message.Type != "poll" {
+		p.Message.Type = req.Type
+	}
+	// The signature is added again like on an edit through the API, unless
+	// the editor kept it in the text
+	p.Message.Text = req.Text
+	if signature := channelSettings(p.Message.ChannelId).MessageSignature; signature != "" {
+		if suffix := "\n\n---\n" + signature; !strings.HasSuffix(p.Message.Text, suffix) {
+			p.Message.Text = p.Message.Text + suffix
+		}
+	}
+
+	if err := dbSavePendingMessage(ctx, p); err != nil {
+		http.Error(w, "Failed to edit pending message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func approvePendingMessage(w http.ResponseWriter, r *http.Request) {
+	reviewPendingMessage(w, r, true)
+}
+
+func rejectPendingMessage(w http.ResponseWriter, r *http.Request) {
+	reviewPendingMessage(w, r, false)
+}
+
+func reviewPendingMessage(w http.ResponseWriter, r *http.Request, approve bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	var req struct {
+		ID     int    `json:"id"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	p, ok := loadPendingForReview(ctx, w, r, req.ID)
+	if !ok {
+		return
+	}
+
+	// Claim the submission first, so it is reviewed only once
+	removed, err := rdb.ZRem(ctx, pendingListKey(p.Message.ChannelId), p.Message.ID).Result()
+	if err != nil || removed == 0 {
+		http.Error(w, "Message was already reviewed", http.StatusConflict)
+		return
+	}
+
+	p.ReviewedBy = user.PublicName
+	p.ReviewedAt = time.Now()
+
+	if approve {
+		p.Status = PendingStatusApproved
+		p.Message.Timestamp = time.Now()
+
+		if p.Message.PublishAt.After(time.Now()) {
+			err = dbSetScheduledMessage(ctx, p.Message)
+		} else {
+			p.Message.PublishAt = time.Time{}
+			err = publishMessage(ctx, p.Message, true)
+		}
+	} else {
+		p.Status = PendingStatusRejected
+		p.RejectReason = req.Reason
+
+		if p.Message.ExternalId != "" {
+			dbReleaseExternalId(ctx, p.Message.ChannelId, p.Message.ExternalId)
+		}
+	}
+
+	if err != nil {
+		log.Printf("Failed to publish approved message %d: %v\n", p.Message.ID, err)
+		rdb.ZAdd(ctx, pendingListKey(p.Message.ChannelId), redis.Z{Score: float64(p.SubmittedAt.Unix()), Member: p.Message.ID})
+		http.Error(w, "Failed to publish message", http.StatusInternalServerError)
+		return
+	}
+
+	if err := dbSavePendingMessage(ctx, p); err != nil {
+		log.Printf("Failed to save review of message %d: %v\n", p.Message.ID, err)
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
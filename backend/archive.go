@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	archiveInterval  = time.Hour
+	archivePageSize  = 50
+	archiveBatchSize = 500
+)
+
+// archiveMu keeps the background job and manual runs from writing the same
+// directory at the same time.
+var archiveMu sync.Mutex
+
+type ArchiveMessage struct {
+	ID        int
+	Author    string
+	Timestamp time.Time
+	LastEdit  time.Time
+	Text      string
+	Replies   []*ArchiveMessage
+}
+
+type ArchiveMonth struct {
+	Key      string
+	Messages []*ArchiveMessage
+}
+
+type ArchiveReport struct {
+	Months      int `json:"months"`
+	Regenerated int `json:"regenerated"`
+	Removed     int `json:"removed"`
+}
+
+type archivePage struct {
+	ChannelName string
+	Title       string
+	Root        string
+	Month       string
+	Messages    []*ArchiveMessage
+	Message     *ArchiveMessage
+	Months      []archiveMonthLink
+	Page        int
+	PrevPage    string
+	NextPage    string
+}
+
+type archiveMonthLink struct {
+	Key   string
+	Count int
+}
+
+func runArchiveJob() {
+	ticker := time.NewTicker(archiveInterval)
+	defer ticker.Stop()
+
+	for {
+		if settingConfig.ArchivePath != "" {
+			if report, err := generateArchive(); err != nil {
+				log.Printf("Failed to generate static archive: %v\n", err)
+			} else if report.Regenerated > 0 || report.Removed > 0 {
+				log.Printf("Static archive: %d months regenerated, %d removed\n", report.Regenerated, report.Removed)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func generateArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	if settingConfig.ArchivePath == "" {
+		http.Error(w, "Static archive is not configured", http.StatusBadRequest)
+		return
+	}
+
+	report, err := generateArchive()
+	if err != nil {
+		log.Printf("Failed to generate static archive: %v\n", err)
+		http.Error(w, "Failed to generate static archive", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// generateArchive renders the public messages of every channel that does not
+// require authentication into ArchivePath. The default channel is written at
+// its root and the others under channels/{id}.
+func generateArchive() (ArchiveReport, error) {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+
+	var report ArchiveReport
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	channelIds, err := dbGetChannelIds(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	for _, channelId := range channelIds {
+		root := settingConfig.ArchivePath
+		if channelId != defaultChannelId {
+			root = filepath.Join(root, "channels", strconv.Itoa(channelId))
+		}
+
+		if channelSettings(channelId).RequireAuth {
+			removed, err := removeChannelArchive(ctx, channelId, root)
+			if err != nil {
+				return report, fmt.Errorf("channel %d: %v", channelId, err)
+			}
+			report.Removed += removed
+			continue
+		}
+
+		channelReport, err := generateChannelArchive(ctx, channelId, root)
+		if err != nil {
+			return report, fmt.Errorf("channel %d: %v", channelId, err)
+		}
+		report.Months += channelReport.Months
+		report.Regenerated += channelReport.Regenerated
+		report.Removed += channelReport.Removed
+	}
+
+	return report, nil
+}
+
+// removeChannelArchive takes down the archive of a channel that now requires
+// authentication. The default channel shares its root with the others, so
+// only its own months and index are removed there.
+func removeChannelArchive(ctx context.Context, channelId int, root string) (int, error) {
+	monthsKey := fmt.Sprintf("archive:months:%d", channelId)
+
+	fingerprints, err := rdb.HGetAll(ctx, monthsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	if channelId != defaultChannelId {
+		if err := os.RemoveAll(root); err != nil {
+			return 0, err
+		}
+	} else {
+		for monthKey := range fingerprints {
+			if err := os.RemoveAll(filepath.Join(root, archiveMonthPath(monthKey))); err != nil {
+				return 0, err
+			}
+		}
+		if err := os.Remove(filepath.Join(root, "index.html")); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	if err := rdb.Del(ctx, monthsKey).Err(); err != nil {
+		return 0, err
+	}
+	return len(fingerprints), nil
+}
+
+// generateChannelArchive renders the archive of one channel into root. A
+// fingerprint of every month is kept in archive:months:{channelId}, and only
+// months whose content changed since the last run, or whose pages are
+// missing, are written again.
+func generateChannelArchive(ctx context.Context, channelId int, root string) (ArchiveReport, error) {
+	var report ArchiveReport
+	monthsKey := fmt.Sprintf("archive:months:%d", channelId)
+
+	channel, err := getChannelDetails(ctx, channelId)
+	if err != nil {
+		return report, err
+	}
+	channelName := channel["name"]
+
+	months, err := loadArchiveMonths(ctx, channelId)
+	if err != nil {
+		return report, err
+	}
+	report.Months = len(months)
+
+	fingerprints, err := rdb.HGetAll(ctx, monthsKey).Result()
+	if err != nil {
+		return report, err
+	}
+
+	for _, month := range months {
+		fingerprint := archiveFingerprint(channelName, month)
+		_, statErr := os.Stat(filepath.Join(root, archiveMonthPath(month.Key), "index.html"))
+		if fingerprints[month.Key] == fingerprint && statErr == nil {
+			continue
+		}
+
+		if err := writeArchiveMonth(root, channelName, month); err != nil {
+			return report, fmt.Errorf("month %s: %v", month.Key, err)
+		}
+		if err := rdb.HSet(ctx, monthsKey, month.Key, fingerprint).Err(); err != nil {
+			return report, err
+		}
+		report.Regenerated++
+	}
+
+	// Months left without public messages
+	for monthKey := range fingerprints {
+		found := false
+		for _, month := range months {
+			if month.Key == monthKey {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(root, archiveMonthPath(monthKey))); err != nil {
+			return report, err
+		}
+		rdb.HDel(ctx, monthsKey, monthKey)
+		report.Removed++
+	}
+
+	links := make([]archiveMonthLink, 0, len(months))
+	for i := len(months) - 1; i >= 0; i-- {
+		links = append(links, archiveMonthLink{Key: months[i].Key, Count: len(months[i].Messages)})
+	}
+
+	err = writeArchivePage(filepath.Join(root, "index.html"), "index", archivePage{
+		ChannelName: channelName,
+		Title:       channelName,
+		Root:        "",
+		Months:      links,
+	})
+
+	return report, err
+}
+
+// loadArchiveMonths reads the messages that a visitor without an account
+// sees, grouped by the month they were published in. Thread replies are
+// attached to their parent, so a new reply changes the parent's month.
+func loadArchiveMonths(ctx context.Context, channelId int) ([]*ArchiveMonth, error) {
+	byId := make(map[int]*ArchiveMessage)
+	byMonth := make(map[string]*ArchiveMonth)
+	var replies []Message
+
+	for start := int64(0); ; start += archiveBatchSize {
+		messageKeys, err := rdb.ZRange(ctx, timesKey(channelId), start, start+archiveBatchSize-1).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, messageKey := range messageKeys {
+			data, err := rdb.HGetAll(ctx, messageKey).Result()
+			if err != nil {
+				return nil, err
+			}
+
+			message, err := parseMessageFromRedis(data, false, false, false)
+			if err != nil || message.Deleted {
+				continue
+			}
+
+			if message.IsThread && message.ReplyTo > 0 {
+				replies = append(replies, message)
+				continue
+			}
+
+			am := newArchiveMessage(message)
+			byId[am.ID] = am
+
+			monthKey := message.Timestamp.Format("2006-01")
+			if byMonth[monthKey] == nil {
+				byMonth[monthKey] = &ArchiveMonth{Key: monthKey}
+			}
+			byMonth[monthKey].Messages = append(byMonth[monthKey].Messages, am)
+		}
+
+		if len(messageKeys) < archiveBatchSize {
+			break
+		}
+	}
+
+	for _, reply := range replies {
+		if parent, ok := byId[reply.ReplyTo]; ok {
+			parent.Replies = append(parent.Replies, newArchiveMessage(reply))
+		}
+	}
+
+	months := make([]*ArchiveMonth, 0, len(byMonth))
+	for _, month := range byMonth {
+		months = append(months, month)
+	}
+	sort.Slice(months, func(i, j int) bool {
+		return months[i].Key < months[j].Key
+	})
+
+	return months, nil
+}
+
+func newArchiveMessage(message Message) *ArchiveMessage {
+	am := &ArchiveMessage{
+		ID:        message.ID,
+		Timestamp: message.Timestamp,
+		LastEdit:  message.LastEdit,
+		Text:      message.Text,
+	}
+
+	if message.Author != "Anonymous" {
+		am.Author = message.Author
+	}
+
+	return am
+}
+
+func archiveFingerprint(channelName string, month *ArchiveMonth) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", channelName)
+
+	var write func(m *ArchiveMessage)
+	write = func(m *ArchiveMessage) {
+		fmt.Fprintf(hash, "%d\x00%s\x00%d\x00%d\x00%s\n", m.ID, m.Author, m.Timestamp.Unix(), m.LastEdit.Unix(), m.Text)
+		for _, reply := range m.Replies {
+			write(reply)
+		}
+	}
+	for _, m := range month.Messages {
+		write(m)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// archiveMonthURL turns a "2006-01" month key into its "2006/01" directory.
+func archiveMonthURL(monthKey string) string {
+	return strings.Replace(monthKey, "-", "/", 1)
+}
+
+func archiveMonthPath(monthKey string) string {
+	return filepath.FromSlash(archiveMonthURL(monthKey))
+}
+
+// writeArchiveMonth renders a month into a temporary directory and swaps it
+// in, so the served pages are never half written.
+func writeArchiveMonth(root, channelName string, month *ArchiveMonth) error {
+	monthDir := filepath.Join(root, archiveMonthPath(month.Key))
+	tmpDir := monthDir + ".tmp"
+
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	pages := (len(month.Messages) + archivePageSize - 1) / archivePageSize
+	for page := 1; page <= pages; page++ {
+		start := (page - 1) * archivePageSize
+		end := min(start+archivePageSize, len(month.Messages))
+
+		data := archivePage{
+			ChannelName: channelName,
+			Title:       channelName + " - " + month.Key,
+			Root:        "../../",
+			Month:       month.Key,
+			Messages:    month.Messages[start:end],
+			Page:        page,
+		}
+		if page > 1 {
+			data.PrevPage = archivePageName(page - 1)
+		}
+		if page < pages {
+			data.NextPage = archivePageName(page + 1)
+		}
+
+		if err := writeArchivePage(filepath.Join(tmpDir, archivePageName(page)), "month", data); err != nil {
+			return err
+		}
+	}
+
+	for i, m := range month.Messages {
+		data := archivePage{
+			ChannelName: channelName,
+			Title:       channelName + " - " + strconv.Itoa(m.ID),
+			Root:        "../../",
+			Month:       month.Key,
+			Message:     m,
+			Page:        i/archivePageSize + 1,
+		}
+
+		if err := writeArchivePage(filepath.Join(tmpDir, strconv.Itoa(m.ID)+".html"), "message", data); err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(monthDir); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, monthDir)
+}
+
+func archivePageName(page int) string {
+	if page == 1 {
+		return "index.html"
+	}
+	return fmt.Sprintf("page-%d.html", page)
+}
+
+func writeArchivePage(path, name string, data archivePage) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return archiveTemplates.ExecuteTemplate(file, name, data)
+}
+
+// archiveMarkdown renders a message text the way the channel shows it:
+// embedded images are shown inline and other embedded files become links.
+func archiveMarkdown(text string) template.HTML {
+	text = embeddedFilePattern.ReplaceAllStringFunc(text, func(embed string) string {
+		match := embeddedFilePattern.FindStringSubmatch(embed)
+		if match[1] == "image" {
+			return "![](" + match[2] + ")"
+		}
+		return "[" + match[1] + "](" + match[2] + ")"
+	})
+
+	// goldmark escapes raw HTML unless told otherwise
+	return template.HTML(markdownToHTML(text))
+}
+
+var archiveTemplates = template.Must(template.New("archive").Funcs(template.FuncMap{
+	"markdown": archiveMarkdown,
+	"date": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04")
+	},
+	"pageName": archivePageName,
+	"monthURL": archiveMonthURL,
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html dir="auto">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 720px; margin: 0 auto; padding: 1em; }
+article { border-bottom: 1px solid #ddd; padding: 1em 0; }
+.meta { color: #666; font-size: 0.85em; }
+.replies { margin-inline-start: 1.5em; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+<header><h1><a href="{{.Root}}index.html">{{.ChannelName}}</a></h1></header>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "entry"}}<article id="m{{.ID}}">
+<div class="meta"><a href="{{.ID}}.html">{{date .Timestamp}}</a>{{if .Author}} · {{.Author}}{{end}}</div>
+{{markdown .Text}}
+{{if .Replies}}<div class="meta">{{len .Replies}} replies</div>{{end}}
+</article>
+{{end}}
+
+{{define "index"}}{{template "header" .}}
+<ul>
+{{range .Months}}<li><a href="{{monthURL .Key}}/index.html">{{.Key}}</a> ({{.Count}})</li>
+{{end}}</ul>
+{{template "footer" .}}{{end}}
+
+{{define "month"}}{{template "header" .}}
+<h2>{{.Month}}</h2>
+{{range .Messages}}{{template "entry" .}}{{end}}
+<nav>
+{{if .PrevPage}}<a href="{{.PrevPage}}">&laquo;</a>{{end}}
+{{if .NextPage}}<a href="{{.NextPage}}">&raquo;</a>{{end}}
+</nav>
+{{template "footer" .}}{{end}}
+
+{{define "message"}}{{template "header" .}}
+{{with .Message}}<article id="m{{.ID}}">
+<div class="meta">{{date .Timestamp}}{{if .Author}} · {{.Author}}{{end}}</div>
+{{markdown .Text}}
+</article>
+{{if .Replies}}<section class="replies">
+{{range .Replies}}<article id="m{{.ID}}">
+<div class="meta">{{date .Timestamp}}{{if .Author}} · {{.Author}}{{end}}</div>
+{{markdown .Text}}
+</article>
+{{end}}</section>{{end}}{{end}}
+<nav><a href="{{pageName .Page}}">{{.Month}}</a></nav>
+{{template "footer" .}}{{end}}
+`))
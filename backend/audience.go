@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// MessageAudienceEntry is a user who viewed or reacted to a message. Users
+// that are no longer in the user store are listed by id only.
+type MessageAudienceEntry struct {
+	UserId string `json:"userId"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	Emoji  string `json:"emoji,omitempty"`
+}
+
+type MessageAudienceResponse struct {
+	Users []MessageAudienceEntry `json:"users"`
+	Total int                    `json:"total"`
+}
+
+func dbGetMessageViewers(ctx context.Context, messageId int) ([]MessageAudienceEntry, error) {
+	userIds, err := rdb.SMembers(ctx, fmt.Sprintf("message:%d:viewed_by", messageId)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]MessageAudienceEntry, 0, len(userIds))
+	for _, userId := range userIds {
+		entries = append(entries, MessageAudienceEntry{UserId: userId})
+	}
+
+	return entries, nil
+}
+
+// dbGetMessageReactors returns the users with a current reaction. Removed
+// reactions stay in the hash with an empty emoji and are skipped.
+func dbGetMessageReactors(ctx context.Context, messageId int) ([]MessageAudienceEntry, error) {
+	reactions, err := rdb.HGetAll(ctx, fmt.Sprintf("message:%d:reactions", messageId)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]MessageAudienceEntry, 0, len(reactions))
+	for userId, emoji := range reactions {
+		if emoji == "" {
+			continue
+		}
+		entries = append(entries, MessageAudienceEntry{UserId: userId, Emoji: emoji})
+	}
+
+	return entries, nil
+}
+
+// joinAudienceUsers fills in the names and emails of the entries and sorts
+// them by name, so pages stay stable between requests.
+func joinAudienceUsers(ctx context.Context, entries []MessageAudienceEntry) error {
+	users, err := dbGetUsersList(ctx)
+	if err != nil {
+		return err
+	}
+
+	usersById := make(map[string]User, len(users))
+	for _, user := range users {
+		usersById[user.ID] = user
+	}
+
+	for i, entry := range entries {
+		if user, ok := usersById[entry.UserId]; ok {
+			entries[i].Name = user.PublicName
+			entries[i].Email = user.Email
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := strings.ToLower(entries[i].Name), strings.ToLower(entries[j].Name)
+		if a != b {
+			// Unknown users last
+			return b == "" || (a != "" && a < b)
+		}
+		return entries[i].UserId < entries[j].UserId
+	})
+
+	return nil
+}
+
+func getMessageViewers(w http.ResponseWriter, r *http.Request) {
+	serveMessageAudience(w, r, "viewers", dbGetMessageViewers)
+}
+
+func getMessageReactors(w http.ResponseWriter, r *http.Request) {
+	serveMessageAudience(w, r, "reactors", dbGetMessageReactors)
+}
+
+// serveMessageAudience returns a page of the list as JSON, or the whole list
+// as CSV with ?format=csv.
+func serveMessageAudience(w http.ResponseWriter, r *http.Request, name string, load func(context.Context, int) ([]MessageAudienceEntry, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || !messageInChannel(ctx, r, id) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	entries, err := load(ctx, id)
+	if err == nil {
+		err = joinAudienceUsers(ctx, entries)
+	}
+	if err != nil {
+		log.Printf("Failed to get %s of message %d: %v\n", name, id, err)
+		http.Error(w, "Failed to get message "+name, http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		writeMessageAudienceCSV(w, fmt.Sprintf("message-%d-%s.csv", id, name), entries)
+		return
+	}
+
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	response := MessageAudienceResponse{Users: []MessageAudienceEntry{}, Total: len(entries)}
+	if offset < len(entries) {
+		response.Users = entries[offset:min(offset+limit, len(entries))]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeMessageAudienceCSV(w http.ResponseWriter, filename string, entries []MessageAudienceEntry) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	// BOM so spreadsheet apps detect UTF-8 in Hebrew names
+	w.Write([]byte("\ufeff"))
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"user_id", "name", "email", "emoji"})
+	for _, entry := range entries {
+		writer.Write([]string{csvSafe(entry.UserId), csvSafe(entry.Name), csvSafe(entry.Email), entry.Emoji})
+	}
+	writer.Flush()
+}
+
+// csvSafe keeps user controlled values from being run as spreadsheet formulas.
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -44,6 +44,8 @@ type Session struct {
 	Picture    string     `json:"picture,omitempty"`
 	Privileges Privileges `json:"privileges,omitempty"`
 	Blocked    bool       `json:"blocked,omitempty"`
+
+	ChannelPrivileges map[int]Privileges `json:"channelPrivileges,omitempty"`
 }
 
 type Response struct {
@@ -142,6 +144,8 @@ func login(w http.ResponseWriter, r *http.Request) {
 		Privileges: u.Privileges,
 		Blocked:    u.Blocked,
 		Email:      u.Email,
+
+		ChannelPrivileges: u.ChannelPrivileges,
 	}
 
 	session, _ := store.Get(r, cookieName)
@@ -212,7 +216,21 @@ func checkPrivilege(r *http.Request, privilege Privilege) bool {
 		return false
 	}
 
-	return s.Privileges[privilege]
+	return s.HasPrivilege(channelIdFromRequest(r), privilege)
+}
+
+// HasPrivilege reports whether the user has a privilege in a channel, either
+// deployment wide or granted for that channel. Admin is only deployment wide.
+func (s Session) HasPrivilege(channelId int, privilege Privilege) bool {
+	if s.Privileges[privilege] {
+		return true
+	}
+
+	if privilege == Admin {
+		return false
+	}
+
+	return s.ChannelPrivileges[channelId][privilege]
 }
 
 func getUserInfo(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type BookmarksResponse struct {
+	Messages []Message `json:"messages"`
+	Total    int64     `json:"total"`
+}
+
+func dbAddBookmark(ctx context.Context, channelId int, userId string, messageId int) error {
+	return rdb.ZAdd(ctx, bookmarksKey(channelId, userId), redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: fmt.Sprintf("messages:%d", messageId),
+	}).Err()
+}
+
+func dbRemoveBookmark(ctx context.Context, channelId int, userId string, messageId int) error {
+	return rdb.ZRem(ctx, bookmarksKey(channelId, userId), fmt.Sprintf("messages:%d", messageId)).Err()
+}
+
+// dbGetBookmarks returns a user's bookmarks, newest first. Bookmarked messages
+// that were deleted since are kept in place as tombstones without content.
+func dbGetBookmarks(ctx context.Context, channelId int, userId string, offset, limit int64, isAdmin, isModerator bool) ([]Message, int64, error) {
+	key := bookmarksKey(channelId, userId)
+
+	total, err := rdb.ZCard(ctx, key).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	messageKeys, err := rdb.ZRevRange(ctx, key, offset, offset+limit-1).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	messages := []Message{}
+	for _, messageKey := range messageKeys {
+		id, err := strconv.Atoi(strings.TrimPrefix(messageKey, "messages:"))
+		if err != nil {
+			continue
+		}
+
+		data, err := rdb.HGetAll(ctx, messageKey).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Purged messages have no hash left
+		if len(data) == 0 {
+			messages = append(messages, Message{ID: id, ChannelId: channelId, Deleted: true})
+			continue
+		}
+
+		message, err := parseMessageFromRedis(data, isAdmin, true, isModerator)
+		if err != nil {
+			continue
+		}
+
+		if message.Deleted && !isAdmin && !isModerator {
+			message = Message{ID: id, ChannelId: message.ChannelId, Timestamp: message.Timestamp, Deleted: true}
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, total, nil
+}
+
+func getBookmarks(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	channelId := channelIdFromRequest(r)
+	isAdmin := user.Privileges[Admin]
+	isModerator := user.HasPrivilege(channelId, Moderator)
+
+	messages, total, err := dbGetBookmarks(ctx, channelId, user.ID, offset, limit, isAdmin, isModerator)
+	if err != nil {
+		log.Printf("Failed to get bookmarks: %v\n", err)
+		http.Error(w, "Failed to get bookmarks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BookmarksResponse{Messages: messages, Total: total})
+}
+
+func addBookmark(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	var req struct {
+		MessageID int `json:"messageId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	deleted, err := rdb.HGet(ctx, fmt.Sprintf("messages:%d", req.MessageID), "deleted").Result()
+	if err != nil || deleted == "1" || !messageInChannel(ctx, r, req.MessageID) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	if err := dbAddBookmark(ctx, channelIdFromRequest(r), user.ID, req.MessageID); err != nil {
+		log.Printf("Failed to add bookmark: %v\n", err)
+		http.Error(w, "Failed to add bookmark", http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// removeBookmark doesn't check the message, so tombstones of purged
+// messages can be removed too.
+func removeBookmark(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	var req struct {
+		MessageID int `json:"messageId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := dbRemoveBookmark(ctx, channelIdFromRequest(r), user.ID, req.MessageID); err != nil {
+		log.Printf("Failed to remove bookmark: %v\n", err)
+		http.Error(w, "Failed to remove bookmark", http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
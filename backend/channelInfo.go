@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"net/http"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/icza/dyno"
@@ -39,14 +38,17 @@ func getChannelInfo(w http.ResponseWriter, r *http.Request) {
 
 	amount, _ = dyno.GetInteger(amount)
 
-	c, err := getChannelDetails(ctx)
+	channelId := channelIdFromRequest(r)
+	config := channelSettings(channelId)
+
+	c, err := getChannelDetails(ctx, channelId)
 	if err != nil {
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
 
 	var channel Channel
-	channel.Id, _ = strconv.Atoi(c["id"])
+	channel.Id = channelId
 	channel.Name = c["name"]
 	channel.Description = c["description"]
 	channel.LoginDescription = c["login_description"]
@@ -54,17 +56,17 @@ func getChannelInfo(w http.ResponseWriter, r *http.Request) {
 	channel.LogoUrl = c["logoUrl"]
 	channel.ShowCredit = os.Getenv("SHOW_CREDIT") != "false"
 	channel.RequireAuthForViewFiles = settingConfig.RequireAuthForViewFiles
-	channel.ThreadsEnabled = settingConfig.ThreadsEnabled
-	channel.ContactUs = settingConfig.ContactUs
-	channel.GoogleAnalyticsId = settingConfig.GoogleAnalyticsID
-	channel.HideMemberCountForNonAdmins = settingConfig.HideMemberCountForNonAdmins
+	channel.ThreadsEnabled = config.ThreadsEnabled
+	channel.ContactUs = config.ContactUs
+	channel.GoogleAnalyticsId = config.GoogleAnalyticsID
+	channel.HideMemberCountForNonAdmins = config.HideMemberCountForNonAdmins
 
 	// Check if user is admin
 	user, _ := r.Context().Value("user").(*User)
 	isAdmin := user != nil && user.Privileges != nil && user.Privileges["admin"]
 
 	// Set Views based on user's admin status and setting
-	if settingConfig.HideMemberCountForNonAdmins && !isAdmin {
+	if config.HideMemberCountForNonAdmins && !isAdmin {
 		channel.Views = 0
 	} else {
 		channel.Views = amount
@@ -86,23 +88,26 @@ func getChannelInfoPublic(w http.ResponseWriter, r *http.Request) {
 
 	amount, _ = dyno.GetInteger(amount)
 
-	c, err := getChannelDetails(ctx)
+	channelId := channelIdFromRequest(r)
+	config := channelSettings(channelId)
+
+	c, err := getChannelDetails(ctx, channelId)
 	if err != nil {
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
 
 	var channel Channel
-	channel.Id, _ = strconv.Atoi(c["id"])
+	channel.Id = channelId
 	channel.Name = c["name"]
 	channel.Description = c["description"]
 	channel.LoginDescription = c["login_description"]
 	channel.CreatedAt, _ = time.Parse(time.RFC3339, c["created_at"])
 	channel.LogoUrl = c["logoUrl"]
-	channel.HideMemberCountForNonAdmins = settingConfig.HideMemberCountForNonAdmins
+	channel.HideMemberCountForNonAdmins = config.HideMemberCountForNonAdmins
 
 	// For public endpoint (login page), hide member count if setting is enabled
-	if settingConfig.HideMemberCountForNonAdmins {
+	if config.HideMemberCountForNonAdmins {
 		channel.Views = 0
 	} else {
 		channel.Views = amount
@@ -130,7 +135,7 @@ func editChannelInfo(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	if _, err := rdb.HSet(ctx, "channel:1", "name", req.Name, "description", req.Description, "login_description", req.LoginDescription, "logoUrl", req.LogoUrl).Result(); err != nil {
+	if _, err := rdb.HSet(ctx, channelInfoKey(channelIdFromRequest(r)), "name", req.Name, "description", req.Description, "login_description", req.LoginDescription, "logoUrl", req.LogoUrl).Result(); err != nil {
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultChannelId is the channel served under the plain /api routes. Every
+// deployment has it, and data from before channels existed belongs to it.
+const defaultChannelId = 1
+
+type channelIdContextKey struct{}
+
+// channelSettingConfigs caches the merged settings of the channels other
+// than the default one, whose settings are settingConfig itself.
+var channelSettingConfigs sync.Map
+
+// Redis keys of the per-channel indexes. Message hashes and their satellite
+// keys stay global, since message ids are unique across channels.
+func channelInfoKey(channelId int) string     { return fmt.Sprintf("channel:%d", channelId) }
+func timesKey(channelId int) string           { return fmt.Sprintf("m_times:%d", channelId) }
+func pinnedKey(channelId int) string          { return fmt.Sprintf("m_pinned:%d", channelId) }
+func deletedKey(channelId int) string         { return fmt.Sprintf("m_deleted:%d", channelId) }
+func tagKey(channelId int, tag string) string { return fmt.Sprintf("tag:%d:%s", channelId, tag) }
+func tagCountsKey(channelId int) string       { return fmt.Sprintf("tags:counts:%d", channelId) }
+func emojisKey(channelId int) string          { return fmt.Sprintf("emojis:list:%d", channelId) }
+func eventsKey(channelId int) string          { return fmt.Sprintf("events:%d", channelId) }
+func lastReadKey(channelId int) string        { return fmt.Sprintf("last_read:%d", channelId) }
+func purgedKey(channelId int) string          { return fmt.Sprintf("purged:%d", channelId) }
+func subscriptionsKey(channelId int) string   { return fmt.Sprintf("subscriptions:%d", channelId) }
+func externalIdKey(channelId int, externalId string) string {
+	return fmt.Sprintf("external:%d:%s", channelId, externalId)
+}
+func bookmarksKey(channelId int, userId string) string {
+	return fmt.Sprintf("bookmarks:%d:%s", channelId, userId)
+}
+func channelSettingsKey(channelId int) string {
+	return fmt.Sprintf("settings:list:%d", channelId)
+}
+
+// withChannel resolves the {channelId} route parameter, or the default
+// channel for the routes without it, and stores it in the request context.
+func withChannel(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		channelId := defaultChannelId
+
+		if param := chi.URLParam(r, "channelId"); param != "" {
+			id, err := strconv.Atoi(param)
+			if err != nil {
+				http.Error(w, "Channel not found", http.StatusNotFound)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			exists, err := dbChannelExists(ctx, id)
+			cancel()
+			if err != nil || !exists {
+				http.Error(w, "Channel not found", http.StatusNotFound)
+				return
+			}
+			channelId = id
+		}
+
+		ctx := context.WithValue(r.Context(), channelIdContextKey{}, channelId)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func channelIdFromRequest(r *http.Request) int {
+	if channelId, ok := r.Context().Value(channelIdContextKey{}).(int); ok {
+		return channelId
+	}
+	return defaultChannelId
+}
+
+// channelIdFromData returns the channel of a message hash. Messages saved
+// before channels existed have no channel_id and belong to the default one.
+func channelIdFromData(data map[string]string) int {
+	if channelId, err := strconv.Atoi(data["channel_id"]); err == nil && channelId > 0 {
+		return channelId
+	}
+	return defaultChannelId
+}
+
+// channelSettings returns the settings of a channel: the deployment settings
+// with the channel's own overrides applied on top.
+func channelSettings(channelId int) *SettingConfig {
+	if channelId == defaultChannelId || channelId == 0 {
+		return settingConfig
+	}
+
+	if config, ok := channelSettingConfigs.Load(channelId); ok {
+		return config.(*SettingConfig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	global, err := dbGetSettings(ctx)
+	if err != nil {
+		log.Printf("Failed to load settings of channel %d: %v\n", channelId, err)
+		return settingConfig
+	}
+
+	overrides, err := dbGetChannelSettings(ctx, channelId)
+	if err != nil {
+		log.Printf("Failed to load settings of channel %d: %v\n", channelId, err)
+		return settingConfig
+	}
+
+	merged := append(global, overrides...)
+	config := merged.ToConfig()
+	channelSettingConfigs.Store(channelId, config)
+
+	return config
+}
+
+func dbChannelExists(ctx context.Context, channelId int) (bool, error) {
+	if channelId == defaultChannelId {
+		return true, nil
+	}
+	return rdb.SIsMember(ctx, "channels:list", channelId).Result()
+}
+
+func dbGetChannelIds(ctx context.Context) ([]int, error) {
+	members, err := rdb.SMembers(ctx, "channels:list").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int{defaultChannelId}
+	for _, member := range members {
+		if id, err := strconv.Atoi(member); err == nil && id != defaultChannelId {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	return ids, nil
+}
+
+// dbGetMessageChannel returns the channel a stored message belongs to.
+func dbGetMessageChannel(ctx context.Context, messageId int) (int, error) {
+	channelId, err := rdb.HGet(ctx, fmt.Sprintf("messages:%d", messageId), "channel_id").Int()
+	if err != nil {
+		if err == redis.Nil {
+			return defaultChannelId, nil
+		}
+		return 0, err
+	}
+	if channelId <= 0 {
+		return defaultChannelId, nil
+	}
+	return channelId, nil
+}
+
+// messageInChannel reports whether a message exists and belongs to the
+// channel of the request, so ids from another channel cannot be acted on.
+func messageInChannel(ctx context.Context, r *http.Request, messageId int) bool {
+	return dbMessageInChannel(ctx, channelIdFromRequest(r), messageId)
+}
+
+func dbMessageInChannel(ctx context.Context, channelId int, messageId int) bool {
+	exists, err := rdb.Exists(ctx, fmt.Sprintf("messages:%d", messageId)).Result()
+	if err != nil || exists == 0 {
+		return false
+	}
+
+	messageChannelId, err := dbGetMessageChannel(ctx, messageId)
+	return err == nil && messageChannelId == channelId
+}
+
+func dbGetChannelSettings(ctx context.Context, channelId int) (Settings, error) {
+	settingsJSON, err := rdb.Get(ctx, channelSettingsKey(channelId)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return Settings{}, nil
+		}
+		return nil, fmt.Errorf("failed to get channel settings from db: %v", err)
+	}
+
+	var settings Settings
+	if err := json.Unmarshal([]byte(settingsJSON), &settings); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal channel settings: %v", err)
+	}
+
+	return settings, nil
+}
+
+func dbSetChannelSettings(ctx context.Context, channelId int, settings *Settings) error {
+	jsonSettings, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to marshal channel settings: %v", err)
+	}
+
+	if err := rdb.Set(ctx, channelSettingsKey(channelId), jsonSettings, 0).Err(); err != nil {
+		return fmt.Errorf("failed to set channel settings in db: %v", err)
+	}
+
+	channelSettingConfigs.Delete(channelId)
+	return nil
+}
+
+func dbCreateChannel(ctx context.Context, name, description string) (int, error) {
+	// Ids below the default channel's are never handed out
+	if err := rdb.SetNX(ctx, "channel:next_id", defaultChannelId, 0).Err(); err != nil {
+		return 0, err
+	}
+
+	id, err := rdb.Incr(ctx, "channel:next_id").Result()
+	if err != nil {
+		return 0, err
+	}
+
+	channelId := int(id)
+	if err := rdb.HSet(ctx, channelInfoKey(channelId),
+		"id", channelId,
+		"name", name,
+		"description", description,
+		"created_at", time.Now(),
+	).Err(); err != nil {
+		return 0, err
+	}
+
+	if err := rdb.SAdd(ctx, "channels:list", channelId).Err(); err != nil {
+		return 0, err
+	}
+
+	return channelId, nil
+}
+
+type ChannelSummary struct {
+	Id          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	LogoUrl     string `json:"logoUrl"`
+}
+
+func getChannelsList(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ids, err := dbGetChannelIds(ctx)
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	channels := make([]ChannelSummary, 0, len(ids))
+	for _, id := range ids {
+		c, err := getChannelDetails(ctx, id)
+		if err != nil {
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+
+		channels = append(channels, ChannelSummary{
+			Id:          id,
+			Name:        c["name"],
+			Description: c["description"],
+			LogoUrl:     c["logoUrl"],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channels)
+}
+
+func createChannel(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	channelId, err := dbCreateChannel(ctx, req.Name, req.Description)
+	if err != nil {
+		log.Printf("Failed to create channel: %v\n", err)
+		http.Error(w, "Failed to create channel", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ChannelSummary{Id: channelId, Name: req.Name, Description: req.Description})
+}
+
+// setChannelPrivileges grants a user writer or moderator privileges in the
+// channel of the request only.
+func setChannelPrivileges(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var req struct {
+		Email      string     `json:"email"`
+		Privileges Privileges `json:"privileges"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// Admin is deployment wide and cannot be granted per channel
+	delete(req.Privileges, Admin)
+
+	users, err := dbGetUsersList(ctx)
+	if err != nil {
+		http.Error(w, "Failed to get users list", http.StatusInternalServerError)
+		return
+	}
+
+	channelId := channelIdFromRequest(r)
+	found := false
+	for i, user := range users {
+		if user.Email != req.Email {
+			continue
+		}
+
+		if users[i].ChannelPrivileges == nil {
+			users[i].ChannelPrivileges = make(map[int]Privileges)
+		}
+		users[i].ChannelPrivileges[channelId] = req.Privileges
+		found = true
+		break
+	}
+
+	if !found {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := dbSetUsersList(ctx, users); err != nil {
+		http.Error(w, "Failed to set users list", http.StatusInternalServerError)
+		return
+	}
+
+	initializePrivilegeUsers()
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MessageCursor is a position in m_times:1. Messages are ordered by score
+// (the timestamp) and then by id, which gives a stable total order even when
+// several messages share the same second.
+type MessageCursor struct {
+	Score     float64 `json:"s"`
+	ID        int     `json:"i"`
+	Direction string  `json:"d"`
+}
+
+type CursorMessagesResponse struct {
+	Messages []Message `json:"messages"`
+	Next     string    `json:"next,omitempty"`
+	Prev     string    `json:"prev,omitempty"`
+	HasMore  bool      `json:"hasMore"`
+}
+
+func (c MessageCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeMessageCursor(s string) (MessageCursor, error) {
+	var c MessageCursor
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+
+	if c.ID <= 0 {
+		return c, errors.New("invalid cursor position")
+	}
+
+	if c.Direction != "asc" {
+		c.Direction = "desc"
+	}
+
+	return c, nil
+}
+
+func oppositeDirection(direction string) string {
+	if direction == "asc" {
+		return "desc"
+	}
+	return "asc"
+}
+
+func getMessagesByCursorHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	cursor := MessageCursor{Direction: "desc"}
+	if r.URL.Query().Get("direction") == "asc" {
+		cursor.Direction = "asc"
+	}
+
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		cursor, err = decodeMessageCursor(c)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	channelId := channelIdFromRequest(r)
+	isAuthenticated := false
+	isAdmin := false
+	isModerator := false
+	userId := ""
+
+	session, err := store.Get(r, cookieName)
+	if err == nil {
+		if userSession, ok := session.Values["user"].(Session); ok {
+			isAuthenticated = true
+			isAdmin = userSession.Privileges[Admin]
+			isModerator = userSession.HasPrivilege(channelId, Moderator)
+			userId = userSession.ID
+		}
+	}
+
+	response, err := funcGetMessagesByCursor(ctx, channelId, cursor, int64(limit), isAdmin, channelSettings(channelId).CountViews, isAuthenticated, isModerator)
+	if err != nil {
+		log.Printf("Failed to get messages: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+
+	addViewsToMessages(ctx, channelId, response.Messages, userId)
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/icza/dyno"
@@ -19,21 +21,28 @@ var redisPass = os.Getenv("REDIS_PASSWORD")
 var rdb *redis.Client
 
 type Message struct {
-	ID              int          `json:"id" redis:"id"`
-	Type            string       `json:"type" redis:"type"`
-	Text            string       `json:"text" redis:"text"`
-	Author          string       `json:"author" redis:"author"`
-	AuthorId        string       `json:"authorId" redis:"authorId"`
-	Timestamp       time.Time    `json:"timestamp" redis:"timestamp"`
-	LastEdit        time.Time    `json:"last_edit" redis:"last_edit"`
-	File            FileResponse `json:"file" redis:"-"`
-	Deleted         bool         `json:"deleted" redis:"deleted"`
-	Views           int          `json:"views" redis:"views"`
-	Reactions       Reactions    `json:"reactions" redis:"reactions"`
-	ReplyTo         int          `json:"replyTo,omitempty" redis:"reply_to"`
-	IsThread        bool         `json:"isThread" redis:"is_thread"`
-	OriginalMessage *Message     `json:"originalMessage,omitempty" redis:"-"`
-	ThreadCount     int          `json:"threadCount,omitempty" redis:"-"`
+	ID              int           `json:"id" redis:"id"`
+	Type            string        `json:"type" redis:"type"`
+	Text            string        `json:"text" redis:"text"`
+	Author          string        `json:"author" redis:"author"`
+	AuthorId        string        `json:"authorId" redis:"authorId"`
+	Timestamp       time.Time     `json:"timestamp" redis:"timestamp"`
+	LastEdit        time.Time     `json:"last_edit" redis:"last_edit"`
+	File            FileResponse  `json:"file" redis:"-"`
+	Deleted         bool          `json:"deleted" redis:"deleted"`
+	Views           int           `json:"views" redis:"views"`
+	Reactions       Reactions     `json:"reactions" redis:"reactions"`
+	ReplyTo         int           `json:"replyTo,omitempty" redis:"reply_to"`
+	IsThread        bool          `json:"isThread" redis:"is_thread"`
+	OriginalMessage *Message      `json:"originalMessage,omitempty" redis:"-"`
+	ThreadCount     int           `json:"threadCount,omitempty" redis:"-"`
+	PublishAt       time.Time     `json:"publishAt,omitzero" redis:"-"`
+	Pinned          bool          `json:"pinned" redis:"-"`
+	Poll            *Poll         `json:"poll,omitempty" redis:"poll,omitempty"`
+	PollResults     *PollResults  `json:"pollResults,omitempty" redis:"-"`
+	ChannelId       int           `json:"channelId,omitempty" redis:"channel_id,omitempty"`
+	LinkPreviews    []LinkPreview `json:"linkPreviews,omitempty" redis:"-"`
+	ExternalId      string        `json:"externalId,omitempty" redis:"external_id,omitempty"`
 }
 
 type MessageMetadata struct {
@@ -58,6 +67,9 @@ type User struct {
 	Privileges Privileges `json:"privileges"`
 	Blocked    bool       `json:"blocked"`
 	Deleted    bool       `json:"deleted,omitempty"`
+	// ChannelPrivileges grants privileges in single channels, on top of the
+	// deployment wide Privileges.
+	ChannelPrivileges map[int]Privileges `json:"channelPrivileges,omitempty"`
 }
 
 type PushMessage struct {
@@ -65,7 +77,9 @@ type PushMessage struct {
 	M    Message `json:"message"`
 }
 
-func init() {
+// connectDB connects to the Redis of REDIS_ADDR. It is called from main,
+// so the package can be loaded without a database.
+func connectDB() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	rdb = redis.NewClient(&redis.Options{
@@ -75,12 +89,12 @@ func init() {
 		DB:       0,
 	})
 
-	_, err := rdb.Ping(ctx).Result()
-	if err != nil {
-		log.Fatalf("Connection to db failed: %v \n", err)
+	if _, err := rdb.Ping(ctx).Result(); err != nil {
+		return err
 	}
 
 	log.Println("Connection to DB successful!")
+	return nil
 }
 
 func getMessageNextId(ctx context.Context) int {
@@ -95,29 +109,706 @@ func getMessageNextId(ctx context.Context) int {
 func setMessage(ctx context.Context, m Message, isUpdate bool) error {
 	messageKey := fmt.Sprintf("messages:%d", m.ID)
 
-	if err := rdb.HSet(ctx, messageKey, m).Err(); err != nil {
+	// Edits don't carry the channel, it stays the one the message was created in
+	if isUpdate {
+		channelId, err := dbGetMessageChannel(ctx, m.ID)
+		if err != nil {
+			return err
+		}
+		m.ChannelId = channelId
+	} else if m.ChannelId == 0 {
+		m.ChannelId = defaultChannelId
+	}
+
+	if err := rdb.HSet(ctx, messageKey, m).Err(); err != nil {
+		return err
+	}
+
+	if !isUpdate {
+		if err := rdb.ZAdd(ctx, timesKey(m.ChannelId), redis.Z{Score: float64(m.Timestamp.Unix()), Member: messageKey}).Err(); err != nil {
+			return err
+		}
+
+		if m.IsThread && m.ReplyTo > 0 {
+			if err := dbAddThreadReply(ctx, m.ReplyTo, messageKey, m.Timestamp); err != nil {
+				return err
+			}
+		}
+
+		if m.ExternalId != "" {
+			if err := dbAssignExternalId(ctx, m); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := dbReindexMessageTags(ctx, m.ID); err != nil {
+		return err
+	}
+
+	pushType := "new-message"
+	if isUpdate {
+		pushType = "edit-message"
+	}
+
+	publishEvent(ctx, pushType, m)
+
+	return nil
+}
+
+func publishEvent(ctx context.Context, pushType string, m Message) {
+	if m.ChannelId == 0 {
+		channelId, err := dbGetMessageChannel(ctx, m.ID)
+		if err != nil {
+			log.Printf("Failed to get channel of message %d: %v\n", m.ID, err)
+			return
+		}
+		m.ChannelId = channelId
+	}
+
+	pushMessage := PushMessage{
+		Type: pushType,
+		M:    m,
+	}
+
+	pushMessageData, _ := json.Marshal(pushMessage)
+	rdb.Publish(ctx, eventsKey(m.ChannelId), pushMessageData)
+}
+
+func dbSetMessagePinned(ctx context.Context, messageId int, pinned bool) error {
+	messageKey := fmt.Sprintf("messages:%d", messageId)
+
+	channelId, err := dbGetMessageChannel(ctx, messageId)
+	if err != nil {
+		return err
+	}
+
+	if err := rdb.HSet(ctx, messageKey, "pinned", pinned).Err(); err != nil {
+		return err
+	}
+
+	if pinned {
+		return rdb.ZAdd(ctx, pinnedKey(channelId), redis.Z{Score: float64(time.Now().Unix()), Member: messageKey}).Err()
+	}
+
+	return rdb.ZRem(ctx, pinnedKey(channelId), messageKey).Err()
+}
+
+func dbGetPinnedMessages(ctx context.Context, channelId int, isAdmin, isAuthenticated, isModerator bool) ([]Message, error) {
+	messageKeys, err := rdb.ZRevRange(ctx, pinnedKey(channelId), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []Message{}
+	for _, messageKey := range messageKeys {
+		data, err := rdb.HGetAll(ctx, messageKey).Result()
+		if err != nil || len(data) == 0 {
+			continue
+		}
+
+		if data["deleted"] == "1" && !isAdmin && !isModerator {
+			continue
+		}
+
+		message, err := parseMessageFromRedis(data, isAdmin, isAuthenticated, isModerator)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+func dbGetDeletedMessages(ctx context.Context, channelId int, offset, limit int64) ([]Message, int64, error) {
+	total, err := rdb.ZCard(ctx, deletedKey(channelId)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	messageKeys, err := rdb.ZRevRange(ctx, deletedKey(channelId), offset, offset+limit-1).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	messages := []Message{}
+	for _, messageKey := range messageKeys {
+		data, err := rdb.HGetAll(ctx, messageKey).Result()
+		if err != nil || len(data) == 0 {
+			continue
+		}
+
+		message, err := parseMessageFromRedis(data, true, true, true)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, total, nil
+}
+
+func dbRestoreMessage(ctx context.Context, id int) (Message, error) {
+	messageKey := fmt.Sprintf("messages:%d", id)
+
+	channelId, err := dbGetMessageChannel(ctx, id)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if err := rdb.HSet(ctx, messageKey, "deleted", false).Err(); err != nil {
+		return Message{}, err
+	}
+
+	if err := rdb.ZRem(ctx, deletedKey(channelId), messageKey).Err(); err != nil {
+		return Message{}, err
+	}
+
+	data, err := rdb.HGetAll(ctx, messageKey).Result()
+	if err != nil {
+		return Message{}, err
+	}
+
+	m, err := parseMessageFromRedis(data, true, true, true)
+	if err != nil {
+		return Message{}, err
+	}
+
+	// Messages expired by the retention policy are no longer in the time set.
+	if err := rdb.ZAdd(ctx, timesKey(channelId), redis.Z{Score: float64(m.Timestamp.Unix()), Member: messageKey}).Err(); err != nil {
+		return Message{}, err
+	}
+
+	if m.IsThread && m.ReplyTo > 0 {
+		rdb.Incr(ctx, fmt.Sprintf("message:%d:thread_count", m.ReplyTo))
+	}
+
+	if err := dbReindexMessageTags(ctx, id); err != nil {
+		return Message{}, err
+	}
+
+	return m, nil
+}
+
+// dbPurgeMessage removes every trace of a message, and of the replies in its
+// thread, from the database and returns the ids of the files their texts and
+// earlier revisions refer to, so that they can be removed as well. A
+// tombstone keeps its external id and import mapping taken, so an import
+// doesn't bring the message back.
+func dbPurgeMessage(ctx context.Context, id int) ([]string, error) {
+	messageKey := fmt.Sprintf("messages:%d", id)
+	threadKey := fmt.Sprintf("message:%d:thread", id)
+
+	channelId, err := dbGetMessageChannel(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	fileIds := []string{}
+
+	replyKeys, err := rdb.ZRange(ctx, threadKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, replyKey := range replyKeys {
+		replyId, err := strconv.Atoi(strings.TrimPrefix(replyKey, "messages:"))
+		if err != nil {
+			continue
+		}
+		replyFileIds, err := dbPurgeMessage(ctx, replyId)
+		if err != nil {
+			return nil, err
+		}
+		for _, fileId := range replyFileIds {
+			if !slices.Contains(fileIds, fileId) {
+				fileIds = append(fileIds, fileId)
+			}
+		}
+	}
+
+	values, err := rdb.HMGet(ctx, messageKey, "text", "is_thread", "reply_to", "external_id").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	text, _ := values[0].(string)
+	isThread, _ := values[1].(string)
+
+	// Attachments removed by an edit are still referred to by the revisions
+	revisions, err := dbGetMessageRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	texts := []string{text}
+	for _, revision := range revisions {
+		texts = append(texts, revision.Text)
+	}
+
+	for _, t := range texts {
+		for _, fileId := range extractFileIds(t) {
+			if !slices.Contains(fileIds, fileId) {
+				fileIds = append(fileIds, fileId)
+			}
+		}
+	}
+	replyTo, _ := values[2].(string)
+
+	if externalId, _ := values[3].(string); externalId != "" {
+		if err := rdb.Set(ctx, externalIdKey(channelId, externalId), externalIdPurged, 0).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := rdb.SAdd(ctx, purgedKey(channelId), id).Err(); err != nil {
+		return nil, err
+	}
+
+	if isThread == "1" && replyTo != "" && replyTo != "0" {
+		if err := rdb.ZRem(ctx, fmt.Sprintf("message:%s:thread", replyTo), messageKey).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, setKey := range []string{timesKey(channelId), pinnedKey(channelId), deletedKey(channelId)} {
+		if err := rdb.ZRem(ctx, setKey, messageKey).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Out of the time set the message has no tags left. This runs before the
+	// hash is gone, since the channel of the tags is read from it.
+	if err := dbReindexMessageTags(ctx, id); err != nil {
+		return nil, err
+	}
+
+	if err := rdb.Del(ctx,
+		messageKey,
+		threadKey,
+		fmt.Sprintf("message:%d:thread_count", id),
+		fmt.Sprintf("message:%d:reactions", id),
+		fmt.Sprintf("message:%d:viewed_by", id),
+		fmt.Sprintf("message:%d:revisions", id),
+		fmt.Sprintf("message:%d:poll_votes", id),
+		analyticsKey(id),
+	).Err(); err != nil {
+		return nil, err
+	}
+
+	return fileIds, nil
+}
+
+// dbReindexMessageTags brings the tag index of a message in line with its
+// stored text. Deleted messages, thread replies and messages outside of the
+// time set are not indexed.
+func dbReindexMessageTags(ctx context.Context, id int) error {
+	messageKey := fmt.Sprintf("messages:%d", id)
+	tagsKey := fmt.Sprintf("message:%d:tags", id)
+
+	values, err := rdb.HMGet(ctx, messageKey, "text", "deleted", "is_thread", "channel_id").Result()
+	if err != nil {
+		return err
+	}
+
+	text, _ := values[0].(string)
+	deleted, _ := values[1].(string)
+	isThread, _ := values[2].(string)
+	channel, _ := values[3].(string)
+	channelId := channelIdFromData(map[string]string{"channel_id": channel})
+
+	var newTags []string
+	score, err := rdb.ZScore(ctx, timesKey(channelId), messageKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if err == nil && deleted != "1" && isThread != "1" {
+		newTags = extractHashtags(text)
+	}
+
+	oldTags, err := rdb.SMembers(ctx, tagsKey).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.TxPipeline()
+	for _, tag := range oldTags {
+		if !slices.Contains(newTags, tag) {
+			pipe.ZRem(ctx, tagKey(channelId, tag), messageKey)
+			pipe.ZIncrBy(ctx, tagCountsKey(channelId), -1, tag)
+		}
+	}
+	for _, tag := range newTags {
+		if !slices.Contains(oldTags, tag) {
+			pipe.ZIncrBy(ctx, tagCountsKey(channelId), 1, tag)
+		}
+		pipe.ZAdd(ctx, tagKey(channelId, tag), redis.Z{Score: score, Member: messageKey})
+	}
+	pipe.ZRemRangeByScore(ctx, tagCountsKey(channelId), "-inf", "0")
+
+	pipe.Del(ctx, tagsKey)
+	if len(newTags) > 0 {
+		pipe.SAdd(ctx, tagsKey, newTags)
+	}
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func dbGetTags(ctx context.Context, channelId int) ([]TagCount, error) {
+	res, err := rdb.ZRevRangeWithScores(ctx, tagCountsKey(channelId), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]TagCount, 0, len(res))
+	for _, z := range res {
+		tag, _ := z.Member.(string)
+		tags = append(tags, TagCount{Tag: tag, Count: int64(z.Score)})
+	}
+
+	return tags, nil
+}
+
+func dbSetPollVote(ctx context.Context, messageId int, userId string, vote PollVote) error {
+	votesKey := fmt.Sprintf("message:%d:poll_votes", messageId)
+
+	if len(vote.Options) == 0 {
+		return rdb.HDel(ctx, votesKey, userId).Err()
+	}
+
+	voteJSON, err := json.Marshal(vote)
+	if err != nil {
+		return fmt.Errorf("failed to marshal vote: %v", err)
+	}
+
+	return rdb.HSet(ctx, votesKey, userId, voteJSON).Err()
+}
+
+func dbGetPollVote(ctx context.Context, messageId int, userId string) (PollVote, error) {
+	var vote PollVote
+
+	voteJSON, err := rdb.HGet(ctx, fmt.Sprintf("message:%d:poll_votes", messageId), userId).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return vote, nil
+		}
+		return vote, err
+	}
+
+	if err := json.Unmarshal([]byte(voteJSON), &vote); err != nil {
+		return vote, fmt.Errorf("failed to unmarshal vote: %v", err)
+	}
+
+	return vote, nil
+}
+
+// updatePollResultsScript recounts the votes of a poll and stores the
+// summary on the message in one step, so concurrent votes can't overwrite
+// each other's summary.
+var updatePollResultsScript = redis.NewScript(`
+	local votes = redis.call('HGETALL', KEYS[1])
+	local optionCount = tonumber(ARGV[1])
+	local anonymous = ARGV[2] == 'true'
+
+	local counts = {}
+	for i = 1, optionCount do
+		counts[i] = 0
+	end
+
+	local voters = {}
+	local hasVoters = false
+	local totalVoters = 0
+
+	for i = 1, #votes, 2 do
+		local success, vote = pcall(cjson.decode, votes[i+1])
+		if success and type(vote) == 'table' and type(vote['options']) == 'table' then
+			local counted = false
+			for _, option in ipairs(vote['options']) do
+				option = tonumber(option)
+				if option and option >= 0 and option < optionCount then
+					counts[option+1] = counts[option+1] + 1
+					counted = true
+
+					if not anonymous then
+						local key = tostring(option)
+						voters[key] = voters[key] or {}
+						table.insert(voters[key], {name = vote['name']})
+						hasVoters = true
+					end
+				end
+			end
+
+			if counted then
+				totalVoters = totalVoters + 1
+			end
+		end
+	end
+
+	-- cjson encodes an empty table as an object, so voters is left out
+	local results = {counts = counts, totalVoters = totalVoters}
+	if hasVoters then
+		results['voters'] = voters
+	end
+
+	local resultsJSON = cjson.encode(results)
+	redis.call('HSET', KEYS[2], 'poll_results', resultsJSON)
+	return resultsJSON
+`)
+
+// dbUpdatePollResults recounts the votes of a poll and stores the summary on
+// the message, like the reactions summary.
+func dbUpdatePollResults(ctx context.Context, messageId int, poll *Poll) (*PollResults, error) {
+	resultsJSON, err := updatePollResultsScript.Run(ctx, rdb,
+		[]string{fmt.Sprintf("message:%d:poll_votes", messageId), fmt.Sprintf("messages:%d", messageId)},
+		len(poll.Options), strconv.FormatBool(poll.Anonymous)).Text()
+	if err != nil {
+		return nil, err
+	}
+
+	var results PollResults
+	if err := json.Unmarshal([]byte(resultsJSON), &results); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal poll results: %v", err)
+	}
+
+	return &results, nil
+}
+
+func dbAddMessageRevision(ctx context.Context, messageId int, revision MessageRevision) error {
+	revisionJSON, err := json.Marshal(revision)
+	if err != nil {
+		return fmt.Errorf("failed to marshal revision: %v", err)
+	}
+
+	return rdb.RPush(ctx, fmt.Sprintf("message:%d:revisions", messageId), revisionJSON).Err()
+}
+
+func dbGetMessageRevisions(ctx context.Context, messageId int) ([]MessageRevision, error) {
+	revisionsJSON, err := rdb.LRange(ctx, fmt.Sprintf("message:%d:revisions", messageId), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []MessageRevision{}
+	for i, revisionJSON := range revisionsJSON {
+		var revision MessageRevision
+		if err := json.Unmarshal([]byte(revisionJSON), &revision); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal revision: %v", err)
+		}
+		revision.Revision = i + 1
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
+
+func dbGetMessageRevision(ctx context.Context, messageId int, revisionNumber int) (MessageRevision, error) {
+	var revision MessageRevision
+
+	revisionJSON, err := rdb.LIndex(ctx, fmt.Sprintf("message:%d:revisions", messageId), int64(revisionNumber-1)).Result()
+	if err != nil {
+		return revision, err
+	}
+
+	if err := json.Unmarshal([]byte(revisionJSON), &revision); err != nil {
+		return revision, fmt.Errorf("failed to unmarshal revision: %v", err)
+	}
+	revision.Revision = revisionNumber
+
+	return revision, nil
+}
+
+func dbSetScheduledMessage(ctx context.Context, m Message) error {
+	scheduledKey := fmt.Sprintf("scheduled:%d", m.ID)
+
+	messageJSON, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scheduled message: %v", err)
+	}
+
+	if err := rdb.Set(ctx, scheduledKey, messageJSON, 0).Err(); err != nil {
+		return err
+	}
+
+	if err := rdb.ZAdd(ctx, "scheduled:list", redis.Z{Score: float64(m.PublishAt.Unix()), Member: scheduledKey}).Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func dbGetScheduledMessage(ctx context.Context, id int) (Message, error) {
+	var m Message
+
+	messageJSON, err := rdb.Get(ctx, fmt.Sprintf("scheduled:%d", id)).Result()
+	if err != nil {
+		return m, err
+	}
+
+	if err := json.Unmarshal([]byte(messageJSON), &m); err != nil {
+		return m, fmt.Errorf("failed to unmarshal scheduled message: %v", err)
+	}
+
+	return m, nil
+}
+
+func dbGetScheduledMessages(ctx context.Context) ([]Message, error) {
+	scheduledKeys, err := rdb.ZRange(ctx, "scheduled:list", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []Message{}
+	if len(scheduledKeys) == 0 {
+		return messages, nil
+	}
+
+	values, err := rdb.MGet(ctx, scheduledKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range values {
+		messageJSON, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		var m Message
+		if err := json.Unmarshal([]byte(messageJSON), &m); err != nil {
+			continue
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+// An external id is reserved with externalIdPending before the message id
+// is allocated, so two requests with the same id can't both create a post.
+// Once the post is saved, queued or scheduled the key holds its message id,
+// and it stays taken while any of them exists. A purged message leaves
+// externalIdPurged behind, so the id is never created again.
+const (
+	externalIdPending    = "pending"
+	externalIdPurged     = "purged"
+	externalIdReserveTTL = time.Minute
+)
+
+var reserveExternalIdScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current then
+	if current == ARGV[1] or current == ARGV[3] then
+		return 0
+	end
+	if redis.call('EXISTS', 'messages:' .. current, 'pending:' .. current, 'scheduled:' .. current) > 0 then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// externalIdTaken reports whether an external id already belongs to a
+// message of the channel, or is reserved by a post being created.
+func externalIdTaken(ctx context.Context, channelId int, externalId string) bool {
+	current, err := rdb.Get(ctx, externalIdKey(channelId, externalId)).Result()
+	if err != nil {
+		return false
+	}
+	if current == externalIdPending || current == externalIdPurged {
+		return true
+	}
+
+	exists, err := rdb.Exists(ctx, "messages:"+current, "pending:"+current, "scheduled:"+current).Result()
+	return err != nil || exists > 0
+}
+
+// dbReserveExternalId claims an external id for a new post. It returns false
+// if the id is taken.
+func dbReserveExternalId(ctx context.Context, channelId int, externalId string) (bool, error) {
+	reserved, err := reserveExternalIdScript.Run(ctx, rdb, []string{externalIdKey(channelId, externalId)},
+		externalIdPending, externalIdReserveTTL.Milliseconds(), externalIdPurged).Int()
+	return reserved == 1, err
+}
+
+// dbAssignExternalId points a reserved external id at its message.
+func dbAssignExternalId(ctx context.Context, m Message) error {
+	return rdb.Set(ctx, externalIdKey(m.ChannelId, m.ExternalId), m.ID, 0).Err()
+}
+
+// dbReleaseExternalId frees an external id whose post wasn't created.
+func dbReleaseExternalId(ctx context.Context, channelId int, externalId string) error {
+	return rdb.Del(ctx, externalIdKey(channelId, externalId)).Err()
+}
+
+// claimScheduledScript takes a due message off the schedule in one step, so
+// it is published only once and can't be rescheduled or canceled meanwhile.
+var claimScheduledScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], KEYS[2]) == 0 then
+	return false
+end
+local message = redis.call('GET', KEYS[2])
+redis.call('DEL', KEYS[2])
+return message
+`)
+
+// updateScheduledScript changes a scheduled message only while it is still
+// waiting, so a message the scheduler claimed isn't put back on the list.
+var updateScheduledScript = redis.NewScript(`
+if redis.call('ZSCORE', KEYS[1], KEYS[2]) == false then
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[1])
+redis.call('ZADD', KEYS[1], ARGV[2], KEYS[2])
+return 1
+`)
+
+// deleteScheduledScript removes a scheduled message that wasn't claimed yet.
+var deleteScheduledScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], KEYS[2]) == 0 then
+	return 0
+end
+redis.call('DEL', KEYS[2])
+return 1
+`)
+
+// dbClaimScheduledMessage returns the JSON of a due message and removes it
+// from the schedule. It returns redis.Nil if another instance claimed it,
+// or if it was canceled.
+func dbClaimScheduledMessage(ctx context.Context, scheduledKey string) (string, error) {
+	return claimScheduledScript.Run(ctx, rdb, []string{"scheduled:list", scheduledKey}).Text()
+}
+
+// dbUpdateScheduledMessage saves the changes of a scheduled message. It
+// returns redis.Nil if the message was already published or canceled.
+func dbUpdateScheduledMessage(ctx context.Context, m Message) error {
+	messageJSON, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scheduled message: %v", err)
+	}
+
+	updated, err := updateScheduledScript.Run(ctx, rdb, []string{"scheduled:list", fmt.Sprintf("scheduled:%d", m.ID)},
+		messageJSON, m.PublishAt.Unix()).Int()
+	if err != nil {
 		return err
 	}
-
-	if !isUpdate {
-		if err := rdb.ZAdd(ctx, "m_times:1", redis.Z{Score: float64(m.Timestamp.Unix()), Member: messageKey}).Err(); err != nil {
-			return err
-		}
+	if updated == 0 {
+		return redis.Nil
 	}
+	return nil
+}
 
-	pushType := "new-message"
-	if isUpdate {
-		pushType = "edit-message"
+// dbDeleteScheduledMessage cancels a scheduled message. It returns
+// redis.Nil if the message was already published or canceled.
+func dbDeleteScheduledMessage(ctx context.Context, id int) error {
+	deleted, err := deleteScheduledScript.Run(ctx, rdb, []string{"scheduled:list", fmt.Sprintf("scheduled:%d", id)}).Int()
+	if err != nil {
+		return err
 	}
-
-	pushMessage := PushMessage{
-		Type: pushType,
-		M:    m,
+	if deleted == 0 {
+		return redis.Nil
 	}
-
-	pushMessageData, _ := json.Marshal(pushMessage)
-	rdb.Publish(ctx, "events", pushMessageData)
-
 	return nil
 }
 
@@ -144,6 +835,8 @@ func setReaction(ctx context.Context, messageId int, emoji string, userId string
 		return err
 	}
 
+	recordReactionStats(ctx, messageId, prevReact, react[userId])
+
 	r, err := funcGetSumReactions(ctx, messageId)
 	if err != nil {
 		return err
@@ -153,24 +846,17 @@ func setReaction(ctx context.Context, messageId int, emoji string, userId string
 		return err
 	}
 
-	pushMessage := PushMessage{
-		Type: "reaction",
-		M: Message{
-			ID:        messageId,
-			Reactions: r,
-		},
-	}
-
-	pushMessageData, _ := json.Marshal(pushMessage)
-	rdb.Publish(ctx, "events", pushMessageData)
+	publishEvent(ctx, "reaction", Message{
+		ID:        messageId,
+		Reactions: r,
+	})
 
 	return nil
 }
 
-var getMessageRange = redis.NewScript(`
-	local time_set_key = KEYS[1]
-	local offset_key = KEYS[2]
-
+// messageScriptPrelude parses the common arguments and defines the message
+// helpers shared by the message listing scripts (see messageScriptArgs).
+const messageScriptPrelude = `
 	local required_length = tonumber(ARGV[1])
 	local isAdmin = ARGV[2] == 'true'
 	local countViews = ARGV[3] == 'true'
@@ -187,22 +873,12 @@ var getMessageRange = redis.NewScript(`
 			return 0
 		end
 		
-		local count = 0
-		local all_messages = redis.call('KEYS', 'messages:*')
-		
-		for i, message_key in ipairs(all_messages) do
-			if string.match(message_key, '^messages:%d+$') then
-				local reply_to = redis.call('HGET', message_key, 'reply_to')
-				local is_thread = redis.call('HGET', message_key, 'is_thread')
-				local deleted = redis.call('HGET', message_key, 'deleted')
-				
-				if reply_to == tostring(messageId) and is_thread == '1' and (deleted ~= '1' or isAdmin or isModerator) then
-					count = count + 1
-				end
-			end
+		-- Admins and moderators also see deleted replies
+		if isAdmin or isModerator then
+			return redis.call('ZCARD', 'message:' .. messageId .. ':thread')
 		end
-		
-		return count
+
+		return tonumber(redis.call('GET', 'message:' .. messageId .. ':thread_count') or 0)
 	end
 
 	local function parseMessageData(message_data, messageId)
@@ -231,6 +907,10 @@ var getMessageRange = redis.NewScript(`
 				message[key] = value == '1'
 			elseif key == 'is_thread' then
 				message['isThread'] = value == '1'
+			elseif key == 'channel_id' then
+				message['channelId'] = tonumber(value)
+			elseif key == 'pinned' then
+				message[key] = value == '1'
 			elseif key == 'reply_to' then
 				local replyToValue = tonumber(value)
 				if replyToValue and replyToValue > 0 then
@@ -263,6 +943,25 @@ var getMessageRange = redis.NewScript(`
 				else
 					message[key] = {}
 				end
+			elseif key == 'poll' then
+				local success, parsedPoll = pcall(cjson.decode, value)
+				if success then
+					message[key] = parsedPoll
+				end
+			elseif key == 'poll_results' then
+				local success, parsedResults = pcall(cjson.decode, value)
+				if success then
+					-- Voters are shown to whoever may see the author
+					if not (isAdmin or isModerator or (showAuthorToAuthenticated and isAuthenticated)) then
+						parsedResults['voters'] = nil
+					end
+					message['pollResults'] = parsedResults
+				end
+			elseif key == 'link_previews' then
+				local success, parsedPreviews = pcall(cjson.decode, value)
+				if success then
+					message['linkPreviews'] = parsedPreviews
+				end
 			else
 				message[key] = value
 			end
@@ -307,6 +1006,11 @@ var getMessageRange = redis.NewScript(`
 		
 		return originalMessage
 	end
+`
+
+var getMessageRange = redis.NewScript(messageScriptPrelude + `
+	local time_set_key = KEYS[1]
+	local offset_key = KEYS[2]
 
 	local start_index
 	if direction == 'asc' then
@@ -390,20 +1094,30 @@ var getMessageRange = redis.NewScript(`
 	return cjson.encode(result)
 `)
 
-func funcGetMessageRange(ctx context.Context, start, stop int64, isAdmin, countViews, isAuthenticated bool, isModerator bool, direction string) (MessagesResponse, error) {
-	offsetKeyName := fmt.Sprintf("messages:%d", start)
-	res, err := getMessageRange.Run(ctx, rdb, []string{"m_times:1", offsetKeyName}, []string{
-		strconv.FormatInt(stop, 10),
+func messageScriptArgs(config *SettingConfig, limit int64, isAdmin, countViews, isAuthenticated bool, isModerator bool, direction string) []string {
+	return []string{
+		strconv.FormatInt(limit, 10),
 		strconv.FormatBool(isAdmin),
 		strconv.FormatBool(countViews),
 		strconv.FormatBool(isAuthenticated),
-		strconv.FormatBool(settingConfig.ShowAuthorToAuthenticated),
-		strconv.FormatBool(settingConfig.HideEditTime),
+		strconv.FormatBool(config.ShowAuthorToAuthenticated),
+		strconv.FormatBool(config.HideEditTime),
 		strconv.FormatBool(isModerator),
 		direction,
-		strconv.FormatBool(settingConfig.HideCountViewsForUsers),
-		strconv.FormatBool(settingConfig.ThreadsEnabled),
-	}).Result()
+		strconv.FormatBool(config.HideCountViewsForUsers),
+		strconv.FormatBool(config.ThreadsEnabled),
+	}
+}
+
+func funcGetMessageRange(ctx context.Context, channelId int, start, stop int64, isAdmin, countViews, isAuthenticated bool, isModerator bool, direction string) (MessagesResponse, error) {
+	return funcGetMessageRangeFromSet(ctx, channelId, timesKey(channelId), start, stop, isAdmin, countViews, isAuthenticated, isModerator, direction)
+}
+
+// funcGetMessageRangeFromSet pages through any time set that has the same
+// layout as the channel time set, such as the per-tag sets.
+func funcGetMessageRangeFromSet(ctx context.Context, channelId int, timeSetKey string, start, stop int64, isAdmin, countViews, isAuthenticated bool, isModerator bool, direction string) (MessagesResponse, error) {
+	offsetKeyName := fmt.Sprintf("messages:%d", start)
+	res, err := getMessageRange.Run(ctx, rdb, []string{timeSetKey, offsetKeyName}, messageScriptArgs(channelSettings(channelId), stop, isAdmin, countViews, isAuthenticated, isModerator, direction)).Result()
 
 	if err != nil {
 		return MessagesResponse{}, err
@@ -422,6 +1136,165 @@ func funcGetMessageRange(ctx context.Context, start, stop int64, isAdmin, countV
 	return response, nil
 }
 
+// getMessagesByCursor walks the time set in a total order of (score, id) so
+// that messages sharing a timestamp are neither skipped nor repeated.
+var getMessagesByCursor = redis.NewScript(messageScriptPrelude + `
+	local time_set_key = KEYS[1]
+	local has_cursor = ARGV[11] ~= ''
+	local cursor_score = tonumber(ARGV[11])
+	local cursor_id = tonumber(ARGV[12]) or 0
+	local ascending = direction == 'asc'
+
+	local messages = {}
+	local first_scanned = nil
+	local last_scanned = nil
+	local has_more = true
+
+	local bound = ascending and '-inf' or '+inf'
+	if has_cursor then
+		bound = cursor_score
+	end
+
+	while #messages < required_length do
+		local top
+		if ascending then
+			top = redis.call('ZRANGEBYSCORE', time_set_key, bound, '+inf', 'WITHSCORES', 'LIMIT', 0, 1)
+		else
+			top = redis.call('ZREVRANGEBYSCORE', time_set_key, bound, '-inf', 'WITHSCORES', 'LIMIT', 0, 1)
+		end
+
+		if #top == 0 then
+			has_more = false
+			break
+		end
+
+		local score = tonumber(top[2])
+		local group = {}
+		for _, message_key in ipairs(redis.call('ZRANGEBYSCORE', time_set_key, score, score)) do
+			local messageId = tonumber(string.match(message_key, '%d+'))
+			if messageId then
+				local after_cursor = true
+				if has_cursor and score == cursor_score then
+					if ascending then
+						after_cursor = messageId > cursor_id
+					else
+						after_cursor = messageId < cursor_id
+					end
+				end
+				if after_cursor then
+					table.insert(group, messageId)
+				end
+			end
+		end
+
+		table.sort(group, function(a, b)
+			if ascending then
+				return a < b
+			end
+			return a > b
+		end)
+
+		for _, messageId in ipairs(group) do
+			if #messages >= required_length then
+				break
+			end
+
+			if not first_scanned then
+				first_scanned = { score = score, id = messageId }
+			end
+			last_scanned = { score = score, id = messageId }
+
+			local message_data = redis.call('HGETALL', 'messages:' .. messageId)
+			local message = parseMessageData(message_data, messageId)
+
+			if message and (not message['deleted'] or isAdmin or isModerator) then
+				if not (message['isThread'] and message['replyTo']) then
+					if message['replyTo'] and not message['isThread'] then
+						local originalMessage = getOriginalMessage(tostring(message['replyTo']))
+						if originalMessage then
+							message['originalMessage'] = originalMessage
+						end
+					end
+
+					table.insert(messages, message)
+				end
+			end
+		end
+
+		bound = '(' .. score
+	end
+
+	local result = {
+		first = first_scanned,
+		last = last_scanned,
+		hasMore = has_more
+	}
+	if #messages > 0 then
+		result['messages'] = messages
+	end
+
+	return cjson.encode(result)
+`)
+
+type cursorScriptPosition struct {
+	Score float64 `json:"score"`
+	ID    int     `json:"id"`
+}
+
+type cursorScriptResult struct {
+	Messages []Message             `json:"messages"`
+	First    *cursorScriptPosition `json:"first"`
+	Last     *cursorScriptPosition `json:"last"`
+	HasMore  bool                  `json:"hasMore"`
+}
+
+func funcGetMessagesByCursor(ctx context.Context, channelId int, cursor MessageCursor, limit int64, isAdmin, countViews, isAuthenticated bool, isModerator bool) (CursorMessagesResponse, error) {
+	args := messageScriptArgs(channelSettings(channelId), limit, isAdmin, countViews, isAuthenticated, isModerator, cursor.Direction)
+	if cursor.ID > 0 {
+		args = append(args, strconv.FormatFloat(cursor.Score, 'f', -1, 64), strconv.Itoa(cursor.ID))
+	} else {
+		args = append(args, "", "")
+	}
+
+	res, err := getMessagesByCursor.Run(ctx, rdb, []string{timesKey(channelId)}, args).Result()
+	if err != nil {
+		return CursorMessagesResponse{}, err
+	}
+
+	var result cursorScriptResult
+	resStr, _ := dyno.GetString(res)
+	if err := json.Unmarshal([]byte(resStr), &result); err != nil {
+		return CursorMessagesResponse{}, err
+	}
+
+	response := CursorMessagesResponse{
+		Messages: result.Messages,
+		HasMore:  result.HasMore,
+	}
+	if response.Messages == nil {
+		response.Messages = []Message{}
+	}
+
+	// Next continues in the same direction from the last scanned message, prev
+	// goes back the opposite way from the first one (or from the given cursor).
+	if result.Last != nil {
+		response.Next = MessageCursor{Score: result.Last.Score, ID: result.Last.ID, Direction: cursor.Direction}.Encode()
+	} else if cursor.ID > 0 {
+		response.Next = cursor.Encode()
+	}
+
+	prev := cursor
+	if result.First != nil {
+		prev = MessageCursor{Score: result.First.Score, ID: result.First.ID}
+	}
+	if prev.ID > 0 {
+		prev.Direction = oppositeDirection(cursor.Direction)
+		response.Prev = prev.Encode()
+	}
+
+	return response, nil
+}
+
 var sumMessageReactions = redis.NewScript(`
   local reactions = redis.call('HVALS', KEYS[1])
   local result = {}
@@ -475,30 +1348,57 @@ func updateMessageReactions(ctx context.Context, messageId int, reactions Reacti
 	return nil
 }
 
+func dbAddThreadReply(ctx context.Context, parentId int, messageKey string, timestamp time.Time) error {
+	if err := rdb.ZAdd(ctx, fmt.Sprintf("message:%d:thread", parentId), redis.Z{Score: float64(timestamp.Unix()), Member: messageKey}).Err(); err != nil {
+		return err
+	}
+
+	return rdb.Incr(ctx, fmt.Sprintf("message:%d:thread_count", parentId)).Err()
+}
+
 func funcDeleteMessage(ctx context.Context, id string) error {
 	msgKey := fmt.Sprintf("messages:%s", id)
+
+	prev, err := rdb.HMGet(ctx, msgKey, "deleted", "is_thread", "reply_to", "channel_id").Result()
+	if err != nil {
+		return err
+	}
+	channel, _ := prev[3].(string)
+	channelId := channelIdFromData(map[string]string{"channel_id": channel})
+
 	rdb.HSet(ctx, msgKey, "deleted", true)
 
+	// Deleted replies stay in the thread index for admins, only the counter shown to readers drops.
+	if deleted, _ := prev[0].(string); deleted != "1" {
+		rdb.ZAdd(ctx, deletedKey(channelId), redis.Z{Score: float64(time.Now().Unix()), Member: msgKey})
+
+		isThread, _ := prev[1].(string)
+		replyTo, _ := prev[2].(string)
+		if isThread == "1" && replyTo != "" && replyTo != "0" {
+			rdb.Decr(ctx, fmt.Sprintf("message:%s:thread_count", replyTo))
+		}
+	}
+
 	var m Message
 	idInt, _ := strconv.Atoi(id)
 	m.ID = idInt
+	m.ChannelId = channelId
 	m.Deleted = true
 	m.LastEdit = time.Now()
 	m.Text = "*ההודעה נמחקה*"
 	m.File = FileResponse{}
 
-	pushMessage := PushMessage{
-		Type: "delete-message",
-		M:    m,
+	if err := dbReindexMessageTags(ctx, idInt); err != nil {
+		return err
 	}
-	pushMessageData, _ := json.Marshal(pushMessage)
-	rdb.Publish(ctx, "events", pushMessageData)
+
+	publishEvent(ctx, "delete-message", m)
 
 	return nil
 }
 
-func addViewsToMessages(ctx context.Context, messages []Message, userId string) {
-	if !settingConfig.CountViews {
+func addViewsToMessages(ctx context.Context, channelId int, messages []Message, userId string) {
+	if !channelSettings(channelId).CountViews {
 		return
 	}
 
@@ -519,16 +1419,21 @@ func addViewsToMessages(ctx context.Context, messages []Message, userId string)
 			continue
 		}
 
-		rdb.HIncrBy(ctx, fmt.Sprintf("messages:%d", m.ID), "views", 1)
+		views, err := rdb.HIncrBy(ctx, fmt.Sprintf("messages:%d", m.ID), "views", 1).Result()
+		if err != nil {
+			continue
+		}
+
+		recordViewStats(ctx, m.ID, views)
 	}
 }
 
 // https://redis.io/docs/latest/operate/oss_and_stack/management/security/#string-escaping-and-nosql-injection
-func addSubscription(token string) error {
+func addSubscription(channelId int, token string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := rdb.SAdd(ctx, "subscriptions", token).Result()
+	_, err := rdb.SAdd(ctx, subscriptionsKey(channelId), token).Result()
 	if err != nil {
 		return err
 	}
@@ -536,11 +1441,11 @@ func addSubscription(token string) error {
 	return nil
 }
 
-func getSubcriptionsList() ([]string, error) {
+func getSubcriptionsList(channelId int) ([]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	subscriptionsSet, err := rdb.SMembers(ctx, "subscriptions").Result()
+	subscriptionsSet, err := rdb.SMembers(ctx, subscriptionsKey(channelId)).Result()
 	if err != nil {
 		log.Printf("Failed to get subscriptions: %v\n", err)
 		return []string{}, err
@@ -548,11 +1453,11 @@ func getSubcriptionsList() ([]string, error) {
 	return subscriptionsSet, nil
 }
 
-func getChannelDetails(ctx context.Context) (map[string]string, error) {
-	return rdb.HGetAll(ctx, "channel:1").Result()
+func getChannelDetails(ctx context.Context, channelId int) (map[string]string, error) {
+	return rdb.HGetAll(ctx, channelInfoKey(channelId)).Result()
 }
 
-func dbSetEmojisList(ctx context.Context, emojis []string) error {
+func dbSetEmojisList(ctx context.Context, channelId int, emojis []string) error {
 	// if len(emojis) == 0 {
 	//	return fmt.Errorf("emojis list cannot be empty")
 	// }
@@ -562,7 +1467,7 @@ func dbSetEmojisList(ctx context.Context, emojis []string) error {
 		return fmt.Errorf("failed to marshal emojis: %v", err)
 	}
 
-	if err := rdb.Set(ctx, "emojis:list", emojisJSON, 0).Err(); err != nil {
+	if err := rdb.Set(ctx, emojisKey(channelId), emojisJSON, 0).Err(); err != nil {
 		return fmt.Errorf("failed to set emojis in db: %v", err)
 	}
 
@@ -570,11 +1475,11 @@ func dbSetEmojisList(ctx context.Context, emojis []string) error {
 
 }
 
-func dbGetEmojisList(ctx context.Context) ([]string, error) {
-	emojisJSON, err := rdb.Get(ctx, "emojis:list").Result()
+func dbGetEmojisList(ctx context.Context, channelId int) ([]string, error) {
+	emojisJSON, err := rdb.Get(ctx, emojisKey(channelId)).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return emojis, nil
+			return []string{}, nil
 		}
 		return nil, fmt.Errorf("failed to get emojis from db: %v", err)
 	}
@@ -616,6 +1521,57 @@ func dbGetUsersList(ctx context.Context) ([]User, error) {
 	return usersList, nil
 }
 
+// dbSetFeedToken creates a new personal feed token for a user and revokes the
+// previous one.
+func dbSetFeedToken(ctx context.Context, userId string) (string, error) {
+	token := generatedRandomID(20)
+	if token == "" {
+		return "", fmt.Errorf("failed to generate feed token")
+	}
+
+	oldToken, err := rdb.Get(ctx, "feed_token:"+userId).Result()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+
+	pipe := rdb.TxPipeline()
+	if oldToken != "" {
+		pipe.HDel(ctx, "feed_tokens", oldToken)
+	}
+	pipe.HSet(ctx, "feed_tokens", token, userId)
+	pipe.Set(ctx, "feed_token:"+userId, token, 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// dbIsValidFeedToken reports whether a feed token belongs to an existing user
+// that is not blocked.
+func dbIsValidFeedToken(ctx context.Context, token string) (bool, error) {
+	userId, err := rdb.HGet(ctx, "feed_tokens", token).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return false, nil
+		}
+		return false, err
+	}
+
+	users, err := dbGetUsersList(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, user := range users {
+		if user.ID == userId {
+			return !user.Blocked && !user.Deleted, nil
+		}
+	}
+
+	return false, nil
+}
+
 func dbSetSettings(ctx context.Context, settings *Settings) error {
 	jsonSettings, err := json.Marshal(settings)
 	if err != nil {
@@ -698,101 +1654,113 @@ func syncOldUsersToUsersList(ctx context.Context) error {
 }
 
 var getThreadRepliesScript = redis.NewScript(`
-	local parent_message_id = ARGV[1]
-	local isAdmin = ARGV[2] == 'true'
-	local countViews = ARGV[3] == 'true'
-	local isAuthenticated = ARGV[4] == 'true'
-	local showAuthorToAuthenticated = ARGV[5] == 'true'
-	local hideEditTime = ARGV[6] == 'true'
-	local isModerator = ARGV[7] == 'true'
-
-	local all_messages = redis.call('KEYS', 'messages:*')
+	local isAdmin = ARGV[1] == 'true'
+	local countViews = ARGV[2] == 'true'
+	local isAuthenticated = ARGV[3] == 'true'
+	local showAuthorToAuthenticated = ARGV[4] == 'true'
+	local hideEditTime = ARGV[5] == 'true'
+	local isModerator = ARGV[6] == 'true'
+
+	local thread_keys = redis.call('ZRANGE', KEYS[1], 0, -1)
 	local thread_messages = {}
 
-	for i, message_key in ipairs(all_messages) do
-		if string.match(message_key, '^messages:%d+$') then
-			local reply_to = redis.call('HGET', message_key, 'reply_to')
-			local is_thread = redis.call('HGET', message_key, 'is_thread')
-			
-			if reply_to == parent_message_id and is_thread == '1' then
-				local message_data = redis.call('HGETALL', message_key)
-				local message = {}
-		
-				for j = 1, #message_data, 2 do
-					local key = message_data[j]
-					local value = message_data[j+1]
-		
-					if key == 'id' then
-						message[key] = tonumber(value)
-					elseif key == 'views' then
-						if countViews then
-							message[key] = tonumber(value)
-						else
-							message[key] = 0	
-						end
-					elseif key == 'deleted' then
-						message[key] = value == '1'
-					elseif key == 'is_thread' then
-						message['isThread'] = value == '1'
-					elseif key == 'reply_to' then
-						local replyToValue = tonumber(value)
-						if replyToValue and replyToValue > 0 then
-							message['replyTo'] = replyToValue
-						end
-					elseif key == 'last_edit' then
-						if not hideEditTime then
-							message[key] = value
-						end
-					elseif key == 'author' then
-						if isAdmin or isModerator then
-							message[key] = value
-						elseif showAuthorToAuthenticated and isAuthenticated then
-							message[key] = value
-						else
-							message[key] = "Anonymous"
-						end
-					elseif key == 'authorId' then
-						if isAdmin or isModerator then
-						   message[key] = value
-						elseif showAuthorToAuthenticated and isAuthenticated then
-							message[key] = value
-						else
-						   message[key] = "Anonymous"
-						end
-					elseif key == 'reactions' then
-						local success, parsedReactions = pcall(cjson.decode, value)
-						if success then
-							message[key] = parsedReactions
-						else
-							message[key] = {}
-						end
-					else
-						message[key] = value
+	for i, message_key in ipairs(thread_keys) do
+		local message_data = redis.call('HGETALL', message_key)
+		local message = {}
+
+		for j = 1, #message_data, 2 do
+			local key = message_data[j]
+			local value = message_data[j+1]
+
+			if key == 'id' then
+				message[key] = tonumber(value)
+			elseif key == 'views' then
+				if countViews then
+					message[key] = tonumber(value)
+				else
+					message[key] = 0	
+				end
+			elseif key == 'deleted' then
+				message[key] = value == '1'
+			elseif key == 'is_thread' then
+				message['isThread'] = value == '1'
+			elseif key == 'channel_id' then
+				message['channelId'] = tonumber(value)
+			elseif key == 'pinned' then
+				message[key] = value == '1'
+			elseif key == 'reply_to' then
+				local replyToValue = tonumber(value)
+				if replyToValue and replyToValue > 0 then
+					message['replyTo'] = replyToValue
+				end
+			elseif key == 'last_edit' then
+				if not hideEditTime then
+					message[key] = value
+				end
+			elseif key == 'author' then
+				if isAdmin or isModerator then
+					message[key] = value
+				elseif showAuthorToAuthenticated and isAuthenticated then
+					message[key] = value
+				else
+					message[key] = "Anonymous"
+				end
+			elseif key == 'authorId' then
+				if isAdmin or isModerator then
+				   message[key] = value
+				elseif showAuthorToAuthenticated and isAuthenticated then
+					message[key] = value
+				else
+				   message[key] = "Anonymous"
+				end
+			elseif key == 'reactions' then
+				local success, parsedReactions = pcall(cjson.decode, value)
+				if success then
+					message[key] = parsedReactions
+				else
+					message[key] = {}
+				end
+			elseif key == 'poll' then
+				local success, parsedPoll = pcall(cjson.decode, value)
+				if success then
+					message[key] = parsedPoll
+				end
+			elseif key == 'poll_results' then
+				local success, parsedResults = pcall(cjson.decode, value)
+				if success then
+					-- Voters are shown to whoever may see the author
+					if not (isAdmin or isModerator or (showAuthorToAuthenticated and isAuthenticated)) then
+						parsedResults['voters'] = nil
 					end
+					message['pollResults'] = parsedResults
 				end
-		
-				if not message['deleted'] or isAdmin or isModerator then
-					table.insert(thread_messages, message)
+			elseif key == 'link_previews' then
+				local success, parsedPreviews = pcall(cjson.decode, value)
+				if success then
+					message['linkPreviews'] = parsedPreviews
 				end
+			else
+				message[key] = value
 			end
 		end
-	end
 
-	table.sort(thread_messages, function(a, b)
-		return a.timestamp < b.timestamp
-	end)
+		if not message['deleted'] or isAdmin or isModerator then
+			table.insert(thread_messages, message)
+		end
+	end
 
 	return cjson.encode(thread_messages)
 `)
 
-func funcGetThreadReplies(ctx context.Context, parentMessageId int, isAdmin, countViews, isAuthenticated bool, isModerator bool) ([]Message, error) {
-	res, err := getThreadRepliesScript.Run(ctx, rdb, []string{}, []string{
-		strconv.Itoa(parentMessageId),
+func funcGetThreadReplies(ctx context.Context, channelId int, parentMessageId int, isAdmin, countViews, isAuthenticated bool, isModerator bool) ([]Message, error) {
+	config := channelSettings(channelId)
+	threadKey := fmt.Sprintf("message:%d:thread", parentMessageId)
+	res, err := getThreadRepliesScript.Run(ctx, rdb, []string{threadKey}, []string{
 		strconv.FormatBool(isAdmin),
 		strconv.FormatBool(countViews),
 		strconv.FormatBool(isAuthenticated),
-		strconv.FormatBool(settingConfig.ShowAuthorToAuthenticated),
-		strconv.FormatBool(settingConfig.HideEditTime),
+		strconv.FormatBool(config.ShowAuthorToAuthenticated),
+		strconv.FormatBool(config.HideEditTime),
 		strconv.FormatBool(isModerator),
 	}).Result()
 	if err != nil {
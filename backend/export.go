@@ -0,0 +1,329 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/icza/dyno"
+	"gopkg.in/yaml.v3"
+)
+
+// exportFormatVersion is bumped whenever the layout of the export archive or
+// the fields of its records change in a way readers must know about.
+// The format is documented in SET.md.
+const exportFormatVersion = 1
+
+const exportBatchSize = 500
+
+type ExportManifest struct {
+	FormatVersion  int       `json:"formatVersion"`
+	BackendVersion string    `json:"backendVersion"`
+	ExportedAt     time.Time `json:"exportedAt"`
+	Messages       int       `json:"messages"`
+	Files          int       `json:"files"`
+}
+
+type ExportMessage struct {
+	ID            int                 `json:"id"`
+	Type          string              `json:"type"`
+	Text          string              `json:"text"`
+	Author        string              `json:"author"`
+	AuthorId      string              `json:"authorId"`
+	Timestamp     time.Time           `json:"timestamp"`
+	LastEdit      time.Time           `json:"lastEdit,omitzero"`
+	Deleted       bool                `json:"deleted"`
+	Pinned        bool                `json:"pinned"`
+	Views         int                 `json:"views"`
+	ReplyTo       int                 `json:"replyTo,omitempty"`
+	IsThread      bool                `json:"isThread"`
+	ThreadReplies []int               `json:"threadReplies,omitempty"`
+	Reactions     Reactions           `json:"reactions,omitempty"`
+	UserReactions map[string]string   `json:"userReactions,omitempty"`
+	Poll          *Poll               `json:"poll,omitempty"`
+	PollVotes     map[string]PollVote `json:"pollVotes,omitempty"`
+	Revisions     []MessageRevision   `json:"revisions,omitempty"`
+}
+
+type ExportFile struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Hash     string `json:"hash"`
+	Type     string `json:"type"`
+	Deleted  bool   `json:"deleted"`
+	Path     string `json:"path,omitempty"`
+}
+
+func exportChannel(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Hour)
+	defer cancel()
+
+	channelId := channelIdFromRequest(r)
+	filename := fmt.Sprintf("channel-%d-export-%s.zip", channelId, time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	// Once streaming started the status can no longer change, so errors
+	// only abort the archive, which leaves it without a central directory.
+	if err := writeChannelExport(ctx, channelId, w); err != nil {
+		log.Printf("Failed to export channel: %v\n", err)
+	}
+}
+
+func writeChannelExport(ctx context.Context, channelId int, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	manifest := ExportManifest{
+		FormatVersion:  exportFormatVersion,
+		BackendVersion: Version,
+		ExportedAt:     time.Now(),
+	}
+
+	channel, err := getChannelDetails(ctx, channelId)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(zw, "channel.json", channel); err != nil {
+		return err
+	}
+
+	emojisList, err := dbGetEmojisList(ctx, channelId)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(zw, "emojis.json", emojisList); err != nil {
+		return err
+	}
+
+	fileIds := make(map[string]bool)
+	for _, fileId := range extractFileIds(channel["logoUrl"]) {
+		fileIds[fileId] = true
+	}
+
+	messagesWriter, err := zw.Create("messages.jsonl")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(messagesWriter)
+
+	for start := int64(0); ; start += exportBatchSize {
+		messageKeys, err := rdb.ZRange(ctx, timesKey(channelId), start, start+exportBatchSize-1).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, messageKey := range messageKeys {
+			message, err := dbGetExportMessage(ctx, messageKey)
+			if err != nil {
+				log.Printf("Skipping %s in export: %v\n", messageKey, err)
+				continue
+			}
+
+			if err := encoder.Encode(message); err != nil {
+				return err
+			}
+			manifest.Messages++
+
+			for _, fileId := range extractFileIds(message.Text) {
+				fileIds[fileId] = true
+			}
+			for _, revision := range message.Revisions {
+				for _, fileId := range extractFileIds(revision.Text) {
+					fileIds[fileId] = true
+				}
+			}
+		}
+
+		if len(messageKeys) < exportBatchSize {
+			break
+		}
+	}
+
+	files, err := writeExportFiles(zw, fileIds)
+	if err != nil {
+		return err
+	}
+	manifest.Files = len(files)
+
+	if err := writeZipJSON(zw, "files.json", files); err != nil {
+		return err
+	}
+
+	if err := writeZipJSON(zw, "manifest.json", manifest); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func dbGetExportMessage(ctx context.Context, messageKey string) (ExportMessage, error) {
+	var em ExportMessage
+
+	data, err := rdb.HGetAll(ctx, messageKey).Result()
+	if err != nil {
+		return em, err
+	}
+	if len(data) == 0 {
+		return em, fmt.Errorf("message hash is missing")
+	}
+
+	message, err := parseMessageFromRedis(data, true, true, true)
+	if err != nil {
+		return em, err
+	}
+
+	em = ExportMessage{
+		ID:        message.ID,
+		Type:      message.Type,
+		Text:      message.Text,
+		Author:    message.Author,
+		AuthorId:  message.AuthorId,
+		Timestamp: message.Timestamp,
+		Deleted:   message.Deleted,
+		Pinned:    message.Pinned,
+		ReplyTo:   message.ReplyTo,
+		IsThread:  message.IsThread,
+		Reactions: message.Reactions,
+		Poll:      message.Poll,
+	}
+
+	// parseMessageFromRedis hides these according to the display settings
+	em.Views, _ = strconv.Atoi(data["views"])
+	em.LastEdit, _ = time.Parse(time.RFC3339, data["last_edit"])
+
+	replies, err := rdb.ZRange(ctx, fmt.Sprintf("message:%d:thread", em.ID), 0, -1).Result()
+	if err != nil {
+		return em, err
+	}
+	for _, replyKey := range replies {
+		if replyId, err := strconv.Atoi(strings.TrimPrefix(replyKey, "messages:")); err == nil {
+			em.ThreadReplies = append(em.ThreadReplies, replyId)
+		}
+	}
+
+	userReactions, err := rdb.HGetAll(ctx, fmt.Sprintf("message:%d:reactions", em.ID)).Result()
+	if err != nil {
+		return em, err
+	}
+	for userId, emoji := range userReactions {
+		if emoji == "" {
+			continue
+		}
+		if em.UserReactions == nil {
+			em.UserReactions = make(map[string]string)
+		}
+		em.UserReactions[userId] = emoji
+	}
+
+	if em.Poll != nil {
+		votes, err := rdb.HGetAll(ctx, fmt.Sprintf("message:%d:poll_votes", em.ID)).Result()
+		if err != nil {
+			return em, err
+		}
+		for userId, voteJSON := range votes {
+			var vote PollVote
+			if json.Unmarshal([]byte(voteJSON), &vote) != nil {
+				continue
+			}
+			if em.PollVotes == nil {
+				em.PollVotes = make(map[string]PollVote)
+			}
+			em.PollVotes[userId] = vote
+		}
+	}
+
+	em.Revisions, err = dbGetMessageRevisions(ctx, em.ID)
+	if err != nil {
+		return em, err
+	}
+
+	return em, nil
+}
+
+// writeExportFiles adds the stored blobs of the referenced files under
+// files/{hash}, once per hash, and returns their metadata.
+func writeExportFiles(zw *zip.Writer, fileIds map[string]bool) ([]ExportFile, error) {
+	ids := make([]string, 0, len(fileIds))
+	for fileId := range fileIds {
+		ids = append(ids, fileId)
+	}
+	sort.Strings(ids)
+
+	files := []ExportFile{}
+	written := make(map[string]bool)
+
+	for _, fileId := range ids {
+		metadataFile, err := os.ReadFile(fileMetadataPath(fileId))
+		if err != nil {
+			log.Printf("Skipping file %s in export: %v\n", fileId, err)
+			continue
+		}
+
+		var metaData map[string]any
+		if err := yaml.Unmarshal(metadataFile, &metaData); err != nil {
+			log.Printf("Skipping file %s in export: %v\n", fileId, err)
+			continue
+		}
+
+		file := ExportFile{ID: fileId}
+		file.Filename, _ = dyno.GetString(metaData["filename"])
+		file.Hash, _ = dyno.GetString(metaData["hash"])
+		file.Type, _ = dyno.GetString(metaData["type"])
+		file.Deleted, _ = metaData["delete"].(bool)
+
+		if len(file.Hash) >= 4 {
+			file.Path = "files/" + file.Hash
+			if !written[file.Hash] {
+				if err := writeZipFile(zw, file.Path, filepath.Join(rootUploadPath, file.Hash[:2], file.Hash[2:4], file.Hash)); err != nil {
+					if !os.IsNotExist(err) {
+						return nil, err
+					}
+					log.Printf("Blob of file %s is missing: %v\n", fileId, err)
+					file.Path = ""
+				} else {
+					written[file.Hash] = true
+				}
+			}
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	entry, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func writeZipFile(zw *zip.Writer, name, sourcePath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	entry, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, source)
+	return err
+}
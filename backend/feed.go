@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/icza/dyno"
+	"github.com/redis/go-redis/v9"
+	"github.com/yuin/goldmark"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	feedSize       = 50
+	feedTitleRunes = 80
+)
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+var embeddedFilePattern = regexp.MustCompile(`\[(image|video|audio)-embedded#\]\(([^)\s]+)\)`)
+
+type FeedEnclosure struct {
+	URL    string
+	Type   string
+	Length int64
+}
+
+type FeedItem struct {
+	ID         int
+	Title      string
+	Author     string
+	HTML       string
+	Published  time.Time
+	Updated    time.Time
+	Enclosures []FeedEnclosure
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Creator     string        `xml:"dc:creator,omitempty"`
+	Description string        `xml:"description"`
+	Enclosure   *rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    *atomAuthor `xml:"author"`
+	Content   atomContent `xml:"content"`
+	Links     []atomLink  `xml:"link"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+func getRssFeed(w http.ResponseWriter, r *http.Request) {
+	baseURL := feedBaseURL(r)
+	channel, items, ok := loadFeed(w, r, baseURL)
+	if !ok {
+		return
+	}
+
+	feed := rssFeed{
+		Version: "2.0",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         channel["name"],
+			Link:          baseURL + "/",
+			Description:   channel["description"],
+			LastBuildDate: time.Now().Format(time.RFC1123Z),
+			Items:         []rssItem{},
+		},
+	}
+
+	for _, item := range items {
+		rss := rssItem{
+			Title:       item.Title,
+			Link:        baseURL + "/",
+			GUID:        rssGUID{Value: feedEntryID(baseURL, item.ID)},
+			PubDate:     item.Published.Format(time.RFC1123Z),
+			Creator:     item.Author,
+			Description: item.HTML,
+		}
+
+		// RSS readers only support a single enclosure per item
+		if len(item.Enclosures) > 0 {
+			e := item.Enclosures[0]
+			rss.Enclosure = &rssEnclosure{URL: e.URL, Length: e.Length, Type: e.Type}
+		}
+
+		feed.Channel.Items = append(feed.Channel.Items, rss)
+	}
+
+	writeFeedXML(w, "application/rss+xml; charset=utf-8", feed)
+}
+
+func getAtomFeed(w http.ResponseWriter, r *http.Request) {
+	baseURL := feedBaseURL(r)
+	channel, items, ok := loadFeed(w, r, baseURL)
+	if !ok {
+		return
+	}
+
+	feed := atomFeed{
+		Title:   channel["name"],
+		ID:      baseURL + "/",
+		Updated: time.Now().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: baseURL + "/"},
+			{Href: baseURL + r.URL.RequestURI(), Rel: "self"},
+		},
+		Author:  atomAuthor{Name: channel["name"]},
+		Entries: []atomEntry{},
+	}
+
+	if len(items) > 0 {
+		feed.Updated = items[0].Updated.Format(time.RFC3339)
+	}
+
+	for _, item := range items {
+		entry := atomEntry{
+			Title:     item.Title,
+			ID:        feedEntryID(baseURL, item.ID),
+			Published: item.Published.Format(time.RFC3339),
+			Updated:   item.Updated.Format(time.RFC3339),
+			Content:   atomContent{Type: "html", Value: item.HTML},
+			Links:     []atomLink{{Href: baseURL + "/"}},
+		}
+
+		if item.Author != "" {
+			entry.Author = &atomAuthor{Name: item.Author}
+		}
+
+		for _, e := range item.Enclosures {
+			entry.Links = append(entry.Links, atomLink{Href: e.URL, Rel: "enclosure", Type: e.Type, Length: e.Length})
+		}
+
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	writeFeedXML(w, "application/atom+xml; charset=utf-8", feed)
+}
+
+// loadFeed checks who reads the feed and returns the channel details and its
+// latest items. A logged in session or a personal feed token count as an
+// authenticated reader; when RequireAuth is on one of them is required.
+func loadFeed(w http.ResponseWriter, r *http.Request, baseURL string) (map[string]string, []FeedItem, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	channelId := channelIdFromRequest(r)
+	isAuthenticated := false
+
+	session, err := store.Get(r, cookieName)
+	if err == nil {
+		if userSession, ok := session.Values["user"].(Session); ok && !userSession.Blocked {
+			isAuthenticated = true
+		}
+	}
+
+	if !isAuthenticated {
+		if token := r.URL.Query().Get("token"); token != "" {
+			isAuthenticated, err = dbIsValidFeedToken(ctx, token)
+			if err != nil {
+				log.Printf("Failed to check feed token: %v\n", err)
+				http.Error(w, "error", http.StatusInternalServerError)
+				return nil, nil, false
+			}
+		}
+	}
+
+	if channelSettings(channelId).RequireAuth && !isAuthenticated {
+		http.Error(w, "A valid feed token is required", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	channel, err := getChannelDetails(ctx, channelId)
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	items, err := getFeedItems(ctx, channelId, isAuthenticated, baseURL)
+	if err != nil {
+		log.Printf("Failed to get feed items: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	return channel, items, true
+}
+
+// getFeedItems returns the latest messages that are neither deleted nor
+// thread replies, newest first.
+func getFeedItems(ctx context.Context, channelId int, isAuthenticated bool, baseURL string) ([]FeedItem, error) {
+	items := []FeedItem{}
+
+	for start := int64(0); len(items) < feedSize; start += feedSize {
+		messageKeys, err := rdb.ZRevRange(ctx, timesKey(channelId), start, start+feedSize-1).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, messageKey := range messageKeys {
+			data, err := rdb.HGetAll(ctx, messageKey).Result()
+			if err != nil {
+				return nil, err
+			}
+
+			message, err := parseMessageFromRedis(data, false, isAuthenticated, false)
+			if err != nil || message.Deleted || message.IsThread {
+				continue
+			}
+
+			items = append(items, newFeedItem(message, baseURL))
+			if len(items) == feedSize {
+				break
+			}
+		}
+
+		if len(messageKeys) < feedSize {
+			break
+		}
+	}
+
+	return items, nil
+}
+
+func newFeedItem(message Message, baseURL string) FeedItem {
+	item := FeedItem{
+		ID:        message.ID,
+		Published: message.Timestamp,
+		Updated:   message.Timestamp,
+	}
+
+	if !message.LastEdit.IsZero() && message.LastEdit.After(message.Timestamp) {
+		item.Updated = message.LastEdit
+	}
+
+	if message.Author != "Anonymous" {
+		item.Author = message.Author
+	}
+
+	// Feed readers do not resolve links relative to the channel
+	text := strings.ReplaceAll(message.Text, "](/api/files/", "]("+baseURL+"/api/files/")
+
+	// Images stay visible in the content, every embedded file becomes an enclosure
+	text = embeddedFilePattern.ReplaceAllStringFunc(text, func(embed string) string {
+		match := embeddedFilePattern.FindStringSubmatch(embed)
+		item.Enclosures = append(item.Enclosures, newFeedEnclosure(match[2], match[1]))
+
+		if match[1] == "image" {
+			return "![](" + match[2] + ")"
+		}
+		return ""
+	})
+
+	item.HTML = markdownToHTML(text)
+	item.Title = feedTitle(item.HTML)
+
+	return item
+}
+
+// newFeedEnclosure describes an embedded file, using its uploaded metadata
+// for the real type and size when the file is one of ours.
+func newFeedEnclosure(fileURL, kind string) FeedEnclosure {
+	enclosure := FeedEnclosure{URL: fileURL, Type: kind + "/*"}
+
+	fileIds := extractFileIds(fileURL)
+	if len(fileIds) == 0 {
+		return enclosure
+	}
+
+	metadataFile, err := os.ReadFile(fileMetadataPath(fileIds[0]))
+	if err != nil {
+		return enclosure
+	}
+
+	var metaData map[string]any
+	if err := yaml.Unmarshal(metadataFile, &metaData); err != nil {
+		return enclosure
+	}
+
+	filename, _ := dyno.GetString(metaData["filename"])
+	if mimeType := mime.TypeByExtension(filepath.Ext(filename)); mimeType != "" {
+		enclosure.Type = mimeType
+	}
+
+	if fileHash, _ := dyno.GetString(metaData["hash"]); len(fileHash) >= 4 {
+		if info, err := os.Stat(filepath.Join(rootUploadPath, fileHash[:2], fileHash[2:4], fileHash)); err == nil {
+			enclosure.Length = info.Size()
+		}
+	}
+
+	return enclosure
+}
+
+func markdownToHTML(text string) string {
+	var buf bytes.Buffer
+	if err := goldmark.Convert([]byte(text), &buf); err != nil {
+		buf.Reset()
+		xml.EscapeText(&buf, []byte(text))
+	}
+	return buf.String()
+}
+
+// feedTitle uses the first line of text of the rendered message as the
+// entry title.
+func feedTitle(renderedHTML string) string {
+	text := html.UnescapeString(htmlTagPattern.ReplaceAllString(renderedHTML, ""))
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if utf8.RuneCountInString(line) > feedTitleRunes {
+			line = string([]rune(line)[:feedTitleRunes]) + "…"
+		}
+		return line
+	}
+
+	return ""
+}
+
+func feedEntryID(baseURL string, messageId int) string {
+	return fmt.Sprintf("%s/messages/%d", baseURL, messageId)
+}
+
+func feedBaseURL(r *http.Request) string {
+	if domain := settingConfig.ProjectDomain; domain != "" {
+		if !strings.Contains(domain, "://") {
+			domain = "https://" + domain
+		}
+		return strings.TrimSuffix(domain, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func writeFeedXML(w http.ResponseWriter, contentType string, feed any) {
+	output, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		log.Printf("Failed to render feed: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(xml.Header))
+	w.Write(output)
+}
+
+func getFeedToken(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	token, err := rdb.Get(ctx, "feed_token:"+user.ID).Result()
+	if err == redis.Nil {
+		token, err = dbSetFeedToken(ctx, user.ID)
+	}
+	if err != nil {
+		log.Printf("Failed to get feed token: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+func resetFeedToken(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	token, err := dbSetFeedToken(ctx, user.ID)
+	if err != nil {
+		log.Printf("Failed to reset feed token: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
@@ -8,12 +8,15 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -33,6 +36,141 @@ type FileResponse struct {
 
 var maxBytesReader *http.MaxBytesError
 
+var fileLinkPattern = regexp.MustCompile(`/api/files/([0-9a-f]{40})`)
+
+// extractFileIds returns the ids of the uploaded files linked from a message text.
+func extractFileIds(text string) []string {
+	var ids []string
+	for _, match := range fileLinkPattern.FindAllStringSubmatch(text, -1) {
+		ids = append(ids, match[1])
+	}
+	return ids
+}
+
+func fileMetadataPath(fileId string) string {
+	return filepath.Join(rootUploadPath, fileId[:2], fileId[2:4], fileId+".yaml")
+}
+
+// purgeFiles removes the metadata of uploaded files, and the stored blobs
+// that no other metadata file refers to. The uploads are scanned once for
+// the hashes still in use.
+func purgeFiles(fileIds []string) error {
+	var hashes []string
+	var errs []error
+
+	for _, fileId := range fileIds {
+		fileHash, err := removeFileMetadata(fileId)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("file %s: %v", fileId, err))
+			continue
+		}
+		if len(fileHash) >= 4 {
+			hashes = append(hashes, fileHash)
+		}
+	}
+
+	if len(hashes) == 0 {
+		return errors.Join(errs...)
+	}
+
+	referenced, err := referencedFileHashes()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+
+	for _, fileHash := range hashes {
+		if referenced[fileHash] {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(rootUploadPath, fileHash[:2], fileHash[2:4], fileHash))
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// removeFileMetadata removes the metadata of an uploaded file and returns
+// the hash of its blob.
+func removeFileMetadata(fileId string) (string, error) {
+	metadataFilePath := fileMetadataPath(fileId)
+	metadataFile, err := os.ReadFile(metadataFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	var metaData map[string]any
+	if err := yaml.Unmarshal(metadataFile, &metaData); err != nil {
+		return "", err
+	}
+
+	if err := os.Remove(metadataFilePath); err != nil {
+		return "", err
+	}
+
+	fileHash, _ := dyno.GetString(metaData["hash"])
+	return fileHash, nil
+}
+
+// referencedFileHashes returns the hashes the remaining metadata files refer to.
+func referencedFileHashes() (map[string]bool, error) {
+	referenced := map[string]bool{}
+
+	err := filepath.WalkDir(rootUploadPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(p) != ".yaml" {
+			return nil
+		}
+
+		metadataFile, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+
+		var metaData map[string]any
+		if err := yaml.Unmarshal(metadataFile, &metaData); err != nil {
+			return nil
+		}
+
+		if h, _ := dyno.GetString(metaData["hash"]); h != "" {
+			referenced[h] = true
+		}
+
+		return nil
+	})
+
+	return referenced, err
+}
+
+func markFileDeleted(fileId string) error {
+	metadataFilePath := fileMetadataPath(fileId)
+	metadataFile, err := os.ReadFile(metadataFilePath)
+	if err != nil {
+		return err
+	}
+
+	var metaData map[string]any
+	if err := yaml.Unmarshal(metadataFile, &metaData); err != nil {
+		return err
+	}
+
+	metaData["delete"] = true
+
+	yamlData, err := yaml.Marshal(metaData)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(metadataFilePath, yamlData, 0644)
+}
+
 func serveFile(w http.ResponseWriter, r *http.Request) {
 	fileId := chi.URLParam(r, "fileid")
 
@@ -193,7 +331,7 @@ func getFavicon(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	c, err := getChannelDetails(ctx)
+	c, err := getChannelDetails(ctx, defaultChannelId)
 	if err != nil {
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	idempotencyMaxKeyLength = 255
+	// idempotencyLockTTL bounds how long a request in progress holds its key,
+	// so a crashed request doesn't block the retries for the whole window.
+	// The lock is extended while the handler runs, uploads can take longer.
+	idempotencyLockTTL = time.Minute
+	idempotencyPending = "pending"
+	// idempotencyMaxMemory is the part of a multipart body kept in memory
+	// while it is fingerprinted for a replay, the rest goes to temp files
+	idempotencyMaxMemory = 32 << 20
+)
+
+type idempotentResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+	// BodyHash is the fingerprint of the request, so the key can't be
+	// reused for a different post
+	BodyHash string `json:"bodyHash,omitempty"`
+}
+
+// responseRecorder keeps a copy of what a handler writes.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+func idempotencyKey(channelId int, apiKeyId string, key string) string {
+	return fmt.Sprintf("idempotency:%d:%s:%s", channelId, apiKeyId, key)
+}
+
+// idempotent makes a post creating handler safe to retry. The first
+// successful response to an Idempotency-Key is stored for the configured
+// window and replayed to later requests of the same API key with the same
+// Idempotency-Key and body, so they don't create the post again. Failed
+// responses aren't stored, the request can be retried as is.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		if len(key) > idempotencyMaxKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// Unauthorized requests are rejected by the handler, before a stored
+		// response could be replayed to them
+		apiKey, err := apiKeyFromRequest(ctx, r)
+		if err != nil {
+			next(w, r)
+			return
+		}
+
+		redisKey := idempotencyKey(channelIdFromRequest(r), apiKey.Id, key)
+
+		claimed, err := rdb.SetNX(ctx, redisKey, idempotencyPending, idempotencyLockTTL).Result()
+		if err != nil {
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+
+		if !claimed {
+			replayIdempotentResponse(ctx, w, r, redisKey)
+			return
+		}
+
+		// The body is hashed as the handler reads it, uploads can be large
+		bodyHash := sha256.New()
+		r.Body = readCloser{io.TeeReader(r.Body, bodyHash), r.Body}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		stopLock := holdIdempotencyLock(redisKey)
+		next(rec, r)
+		stopLock()
+
+		// The handler may have used up the request's time, the outcome is
+		// stored with a time of its own
+		storeCtx, storeCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer storeCancel()
+
+		if rec.status < 200 || rec.status >= 300 {
+			rdb.Del(storeCtx, redisKey)
+			return
+		}
+
+		// What the handler didn't read still counts
+		io.Copy(io.Discard, r.Body)
+
+		// Without a fingerprint the response is still replayed, only the
+		// check for a different request is lost
+		fingerprint := hex.EncodeToString(bodyHash.Sum(nil))
+		if r.MultipartForm != nil {
+			if fingerprint, err = multipartFingerprint(r.MultipartForm); err != nil {
+				log.Printf("Failed to fingerprint idempotent request: %v\n", err)
+			}
+		}
+
+		stored, err := json.Marshal(idempotentResponse{
+			Status:      rec.status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+			BodyHash:    fingerprint,
+		})
+		if err == nil {
+			err = rdb.Set(storeCtx, redisKey, stored, time.Duration(settingConfig.IdempotencyWindowHours)*time.Hour).Err()
+		}
+		if err != nil {
+			log.Printf("Failed to store idempotent response: %v\n", err)
+		}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// holdIdempotencyLock keeps extending the lock of a request in progress
+// until the returned function is called.
+func holdIdempotencyLock(redisKey string) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(idempotencyLockTTL / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := rdb.Expire(ctx, redisKey, idempotencyLockTTL).Err(); err != nil {
+					log.Printf("Failed to extend idempotency lock: %v\n", err)
+				}
+				cancel()
+			}
+		}
+	}()
+
+	// Waits for the goroutine, so it can't touch the key once the
+	// response is stored
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// requestFingerprint returns the fingerprint a stored response is matched
+// against: the SHA-256 of the body, or of the parsed form for multipart.
+func requestFingerprint(r *http.Request) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		h := sha256.New()
+		if _, err := io.Copy(h, r.Body); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	if err := r.ParseMultipartForm(idempotencyMaxMemory); err != nil {
+		return "", err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	return multipartFingerprint(r.MultipartForm)
+}
+
+// multipartFingerprint hashes the fields of a form and the SHA-256 of each
+// file. The raw body can't be compared, its boundary is random per request.
+func multipartFingerprint(form *multipart.Form) (string, error) {
+	h := sha256.New()
+
+	names := make([]string, 0, len(form.Value))
+	for name := range form.Value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range form.Value[name] {
+			fmt.Fprintf(h, "value\x00%s\x00%s\x00", name, value)
+		}
+	}
+
+	names = names[:0]
+	for name := range form.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, header := range form.File[name] {
+			file, err := header.Open()
+			if err != nil {
+				return "", err
+			}
+
+			fileHash := sha256.New()
+			_, err = io.Copy(fileHash, file)
+			file.Close()
+			if err != nil {
+				return "", err
+			}
+
+			fmt.Fprintf(h, "file\x00%s\x00%s\x00%x\x00", name, header.Filename, fileHash.Sum(nil))
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func replayIdempotentResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, redisKey string) {
+	value, err := rdb.Get(ctx, redisKey).Result()
+	if err != nil || value == idempotencyPending {
+		http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+		return
+	}
+
+	var stored idempotentResponse
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	if stored.BodyHash != "" {
+		fingerprint, err := requestFingerprint(r)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if fingerprint != stored.BodyHash {
+			http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	linkPreviewTimeout      = 5 * time.Second
+	linkPreviewMaxBytes     = 512 * 1024
+	linkPreviewMaxLinks     = 3
+	linkPreviewMaxRedirects = 3
+	linkPreviewCacheTTL     = 24 * time.Hour
+	linkPreviewFailureTTL   = time.Hour
+)
+
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+}
+
+var linkPattern = regexp.MustCompile(`https?://[^\s<>()\[\]"'` + "`" + `]+`)
+
+// Ranges that are not covered by the netip.Addr predicates but still must
+// not be reachable from the server.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// linkPreviewClient only connects to public addresses. The check runs on the
+// resolved address of every connection, redirects included, so DNS records
+// pointing inside the network are refused too.
+var linkPreviewClient = &http.Client{
+	Timeout: linkPreviewTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: linkPreviewTimeout,
+			Control: dialPublicOnly,
+		}).DialContext,
+		TLSHandshakeTimeout:   linkPreviewTimeout,
+		ResponseHeaderTimeout: linkPreviewTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= linkPreviewMaxRedirects {
+			return errors.New("too many redirects")
+		}
+		return validatePreviewURL(req.URL)
+	},
+}
+
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !isPublicAddr(addr) {
+		return fmt.Errorf("address %s is not public", host)
+	}
+
+	return nil
+}
+
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return false
+	}
+
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validatePreviewURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("unsupported scheme")
+	}
+	if u.User != nil || u.Hostname() == "" {
+		return errors.New("invalid url")
+	}
+	return nil
+}
+
+// extractLinks returns the distinct links of a message text, in order.
+func extractLinks(text string) []string {
+	links := []string{}
+	seen := make(map[string]bool)
+
+	for _, link := range linkPattern.FindAllString(text, -1) {
+		link = strings.TrimRight(link, ".,;:!?*_~")
+		if seen[link] {
+			continue
+		}
+		seen[link] = true
+
+		links = append(links, link)
+		if len(links) == linkPreviewMaxLinks {
+			break
+		}
+	}
+
+	return links
+}
+
+func linkPreviewKey(link string) string {
+	sum := sha256.Sum256([]byte(link))
+	return "link_preview:" + hex.EncodeToString(sum[:])
+}
+
+// getLinkPreview returns the cached preview of a link, fetching it on a
+// miss. Failed fetches are cached too, as a preview without a title.
+func getLinkPreview(ctx context.Context, link string) LinkPreview {
+	key := linkPreviewKey(link)
+
+	if cached, err := rdb.Get(ctx, key).Result(); err == nil {
+		var preview LinkPreview
+		if json.Unmarshal([]byte(cached), &preview) == nil {
+			return preview
+		}
+	}
+
+	preview, err := fetchLinkPreview(ctx, link)
+	ttl := linkPreviewCacheTTL
+	if err != nil {
+		preview = LinkPreview{URL: link}
+		ttl = linkPreviewFailureTTL
+	}
+
+	if data, err := json.Marshal(preview); err == nil {
+		rdb.Set(ctx, key, data, ttl)
+	}
+
+	return preview
+}
+
+func fetchLinkPreview(ctx context.Context, link string) (LinkPreview, error) {
+	preview := LinkPreview{URL: link}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return preview, err
+	}
+	if err := validatePreviewURL(u); err != nil {
+		return preview, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, linkPreviewTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return preview, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; LinkPreview/1.0)")
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := linkPreviewClient.Do(req)
+	if err != nil {
+		return preview, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return preview, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "text/html") {
+		return preview, errors.New("not an html page")
+	}
+
+	body, err := charset.NewReader(io.LimitReader(resp.Body, linkPreviewMaxBytes), contentType)
+	if err != nil {
+		return preview, err
+	}
+
+	meta, title := parsePreviewMeta(body)
+
+	preview.Title = firstNonEmpty(meta["og:title"], meta["twitter:title"], title)
+	preview.Description = firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"])
+	preview.SiteName = meta["og:site_name"]
+
+	// Relative images are resolved against the page after redirects
+	if image := firstNonEmpty(meta["og:image"], meta["og:image:url"], meta["twitter:image"]); image != "" {
+		if imageURL, err := resp.Request.URL.Parse(image); err == nil && validatePreviewURL(imageURL) == nil {
+			preview.Image = imageURL.String()
+		}
+	}
+
+	preview.Title = truncateRunes(preview.Title, 300)
+	preview.Description = truncateRunes(preview.Description, 500)
+	preview.SiteName = truncateRunes(preview.SiteName, 100)
+
+	if preview.Title == "" {
+		return preview, errors.New("page has no title")
+	}
+
+	return preview, nil
+}
+
+// parsePreviewMeta reads the <meta> tags and the <title> of the page head.
+func parsePreviewMeta(r io.Reader) (map[string]string, string) {
+	meta := make(map[string]string)
+	title := ""
+	inTitle := false
+
+	tokenizer := html.NewTokenizer(r)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return meta, title
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "body":
+				return meta, title
+			case "title":
+				inTitle = title == ""
+			case "meta":
+				var name, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						name = strings.ToLower(attr.Val)
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				if name != "" && content != "" && meta[name] == "" {
+					meta[name] = content
+				}
+			}
+
+		case html.TextToken:
+			if inTitle {
+				title = strings.TrimSpace(string(tokenizer.Text()))
+				inTitle = false
+			}
+
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "head" {
+				return meta, title
+			}
+		}
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
+
+// updateLinkPreviews fetches the previews of the links in a message text,
+// stores them on the message and pushes them to the clients. It runs after
+// the message is saved, so a slow site doesn't hold up posting.
+func updateLinkPreviews(messageId, channelId int, text string) {
+	if !channelSettings(channelId).LinkPreviews {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), linkPreviewMaxLinks*linkPreviewTimeout+5*time.Second)
+	defer cancel()
+
+	previews := []LinkPreview{}
+	for _, link := range extractLinks(text) {
+		if preview := getLinkPreview(ctx, link); preview.Title != "" {
+			previews = append(previews, preview)
+		}
+	}
+
+	messageKey := fmt.Sprintf("messages:%d", messageId)
+
+	// The message may have been edited again while fetching
+	current, err := rdb.HGet(ctx, messageKey, "text").Result()
+	if err != nil || current != text {
+		return
+	}
+
+	// An empty list is removed rather than stored, since the message
+	// scripts would encode it back as an object.
+	if len(previews) == 0 {
+		removed, err := rdb.HDel(ctx, messageKey, "link_previews").Result()
+		if err != nil || removed == 0 {
+			return
+		}
+	} else {
+		data, err := json.Marshal(previews)
+		if err != nil {
+			return
+		}
+
+		if previous, _ := rdb.HGet(ctx, messageKey, "link_previews").Result(); previous == string(data) {
+			return
+		}
+
+		if err := rdb.HSet(ctx, messageKey, "link_previews", data).Err(); err != nil {
+			log.Printf("Failed to save link previews of message %d: %v\n", messageId, err)
+			return
+		}
+	}
+
+	publishEvent(ctx, "link-previews", Message{ID: messageId, ChannelId: channelId, LinkPreviews: previews})
+}
@@ -29,7 +29,7 @@ func protectedWithPrivilege(Privilege Privilege, handler http.HandlerFunc) http.
 func ifRequireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check every time
-		if settingConfig.RequireAuth {
+		if channelSettings(channelIdFromRequest(r)).RequireAuth {
 			checkLogin(next).ServeHTTP(w, r)
 		} else {
 			next.ServeHTTP(w, r)
@@ -39,7 +39,16 @@ func ifRequireAuth(next http.Handler) http.Handler {
 
 func main() {
 	gob.Register(Session{})
+
+	if err := connectDB(); err != nil {
+		log.Fatalf("Connection to db failed: %v \n", err)
+	}
+	if err := loadSettings(); err != nil {
+		panic("Failed to load settings from database: " + err.Error())
+	}
+
 	initializePrivilegeUsers()
+	runMigrations()
 
 	loadFCMConfigFromEnv()
 
@@ -70,74 +79,40 @@ func main() {
 	}
 	defer store.Close()
 
+	go runScheduler()
+	go runRetentionJob()
+	go runArchiveJob()
+	go runAnalyticsRollupJob()
+
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 
-	// Protected with api key
-	// r.Post("/import/post", addNewPost)
-	r.Post("/api/import/post", addNewPost)
-	r.Post("/api/external/post", addNewPost)
-	r.Post("/api/external/post-with-files", addNewPostWithFiles)
-
 	r.Get("/auth/google", getGoogleAuthValues)
 	r.Post("/auth/login", login)
 	r.Post("/auth/logout", logout)
 	r.Get("/assets/favicon.ico", getFavicon)
 	r.Get("/favicon.ico", getFavicon)
 	r.Get("/api/version", getVersion)
-	r.Get("/api/channel/info-public", getChannelInfoPublic)
+	r.Get("/api/channel/list", getChannelsList)
 	r.Get("/api/files/{fileid}", serveFilePublic)
-
-	r.Group(func(r chi.Router) {
-		r.Use(checkLogin)
-		r.Post("/api/reactions/set-reactions", setReactions)
-		r.Post("/api/messages/report", reportMessage)
+	r.Get("/feed.rss", getRssFeed)
+	r.Get("/feed.atom", getAtomFeed)
+	r.Route("/channels/{channelId}", func(r chi.Router) {
+		r.Use(withChannel)
+		r.Get("/feed.rss", getRssFeed)
+		r.Get("/feed.atom", getAtomFeed)
 	})
 
 	r.Group(func(r chi.Router) {
 		r.Use(ifRequireAuth)
 		r.Get("/firebase-messaging-sw.js", getFirebaseMessagingSW)
-		r.Route("/api", func(api chi.Router) {
-			api.Get("/ads/settings", getAdsSettings)
-			api.Get("/emojis/list", getEmojisList)
-			api.Get("/channel/notifications-config", getNotificationsConfig)
-			api.Post("/channel/notifications-subscribe", subscribeNotifications)
-
-			api.Get("/channel/info", getChannelInfo)
-			api.Get("/messages", getMessages)
-			api.Get("/events", getEvents)
-			api.Get("/files/{fileid}", serveFile)
-			api.Get("/user-info", getUserInfo)
-			api.Get("/thread/{messageId}", getThreadRepliesHandler)
-			api.Post("/search", searchMessages)
-
-			api.Route("/admin", func(protected chi.Router) {
-				// ⚠️ WARNING: Route not check privilege use protectedWithPrivilege to check privilege.
-
-				protected.Post("/new", protectedWithPrivilege(Writer, addMessage))
-				protected.Post("/edit-message", protectedWithPrivilege(Writer, updateMessage))
-				protected.Get("/delete-message/{id}", protectedWithPrivilege(Writer, deleteMessage))
-				protected.Post("/upload", protectedWithPrivilege(Writer, uploadFile))
-				protected.Post("/edit-channel-info", protectedWithPrivilege(Moderator, editChannelInfo))
-				protected.Get("/users-amount", protectedWithPrivilege(Moderator, getUsersAmount))
-				protected.Post("/set-emojis", protectedWithPrivilege(Moderator, setEmojis))
-
-				protected.Get("/privilegs-users/get-list", protectedWithPrivilege(Admin, getPrivilegeUsersList))
-				protected.Post("/privilegs-users/set", protectedWithPrivilege(Admin, setPrivilegeUsers))
-				protected.Get("/settings/get", protectedWithPrivilege(Admin, getSettings))
-				protected.Post("/settings/set", protectedWithPrivilege(Admin, setSettings))
-				protected.Get("/reports/get", protectedWithPrivilege(Admin, getReports))
-				protected.Post("/reports/set", protectedWithPrivilege(Admin, setReports))
-
-				protected.Post("/block-user", protectedWithPrivilege(Admin, blockUser))
-				protected.Post("/unblock-user", protectedWithPrivilege(Admin, unblockUser))
-				protected.Get("/blocked-users/get-list", protectedWithPrivilege(Admin, getBlockedUsers))
-				protected.Get("/user-block-status", protectedWithPrivilege(Admin, getUserBlockStatus))
-
-				// temporary
-				protected.Get("/users/get-list", protectedWithPrivilege(Admin, getAllUsers))
-			})
-		})
+	})
+
+	// The default channel is served under /api and every channel, including
+	// the default one, under /api/channels/{channelId}.
+	r.Route("/api", func(api chi.Router) {
+		channelRoutes(api)
+		api.Route("/channels/{channelId}", channelRoutes)
 	})
 
 	if settingConfig.RootStaticFolder != "" {
@@ -150,6 +125,110 @@ func main() {
 	}
 }
 
+func channelRoutes(r chi.Router) {
+	r.Use(withChannel)
+
+	// Protected with api key
+	r.Post("/import/post", idempotent(addNewPost))
+	r.Post("/external/post", idempotent(addNewPost))
+	r.Post("/external/post-with-files", idempotent(addNewPostWithFiles))
+	r.Get("/external/post", getApiPost)
+	r.Post("/external/edit", updateApiPost)
+	r.Post("/external/delete", deleteApiPost)
+
+	r.Get("/channel/info-public", getChannelInfoPublic)
+
+	r.Group(func(r chi.Router) {
+		r.Use(checkLogin)
+		r.Post("/reactions/set-reactions", setReactions)
+		r.Post("/polls/vote", votePoll)
+		r.Get("/polls/my-vote", getMyPollVote)
+		r.Get("/feed-token", getFeedToken)
+		r.Post("/feed-token/reset", resetFeedToken)
+		r.Post("/messages/report", reportMessage)
+		r.Get("/messages/unread", getUnreadStatus)
+		r.Post("/messages/read", markRead)
+		r.Get("/bookmarks/get-list", getBookmarks)
+		r.Post("/bookmarks/add", addBookmark)
+		r.Post("/bookmarks/remove", removeBookmark)
+	})
+
+	r.Group(func(api chi.Router) {
+		api.Use(ifRequireAuth)
+		api.Get("/ads/settings", getAdsSettings)
+		api.Get("/emojis/list", getEmojisList)
+		api.Get("/channel/notifications-config", getNotificationsConfig)
+		api.Post("/channel/notifications-subscribe", subscribeNotifications)
+
+		api.Get("/channel/info", getChannelInfo)
+		api.Get("/messages", getMessages)
+		api.Get("/messages/pinned", getPinnedMessages)
+		api.Get("/messages/cursor", getMessagesByCursorHandler)
+		api.Get("/tags", getTags)
+		api.Get("/events", getEvents)
+		api.Get("/files/{fileid}", serveFile)
+		api.Get("/user-info", getUserInfo)
+		api.Get("/thread/{messageId}", getThreadRepliesHandler)
+		api.Post("/search", searchMessages)
+
+		api.Route("/admin", func(protected chi.Router) {
+			// ⚠️ WARNING: Route not check privilege use protectedWithPrivilege to check privilege.
+
+			protected.Post("/new", protectedWithPrivilege(Writer, addMessage))
+			protected.Post("/edit-message", protectedWithPrivilege(Writer, updateMessage))
+			protected.Get("/delete-message/{id}", protectedWithPrivilege(Writer, deleteMessage))
+			protected.Post("/upload", protectedWithPrivilege(Writer, uploadFile))
+			protected.Get("/scheduled-messages/get-list", protectedWithPrivilege(Writer, getScheduledMessages))
+			protected.Post("/scheduled-messages/reschedule", protectedWithPrivilege(Writer, rescheduleMessage))
+			protected.Post("/scheduled-messages/cancel", protectedWithPrivilege(Writer, cancelScheduledMessage))
+			protected.Get("/approvals/my-submissions", protectedWithPrivilege(Writer, getMySubmissions))
+			protected.Get("/trash/get-list", protectedWithPrivilege(Moderator, getTrash))
+			protected.Post("/trash/restore", protectedWithPrivilege(Moderator, restoreMessage))
+			protected.Get("/approvals/get-list", protectedWithPrivilege(Moderator, getPendingMessages))
+			protected.Post("/approvals/edit", protectedWithPrivilege(Moderator, editPendingMessage))
+			protected.Post("/approvals/approve", protectedWithPrivilege(Moderator, approvePendingMessage))
+			protected.Post("/approvals/reject", protectedWithPrivilege(Moderator, rejectPendingMessage))
+			protected.Post("/pin-message", protectedWithPrivilege(Moderator, pinMessage))
+			protected.Post("/unpin-message", protectedWithPrivilege(Moderator, unpinMessage))
+			protected.Post("/edit-channel-info", protectedWithPrivilege(Moderator, editChannelInfo))
+			protected.Get("/users-amount", protectedWithPrivilege(Moderator, getUsersAmount))
+			protected.Get("/message-revisions/{id}", protectedWithPrivilege(Moderator, getMessageRevisions))
+			protected.Get("/message-viewers/{id}", protectedWithPrivilege(Moderator, getMessageViewers))
+			protected.Get("/message-reactors/{id}", protectedWithPrivilege(Moderator, getMessageReactors))
+			protected.Post("/message-revisions/restore", protectedWithPrivilege(Moderator, restoreMessageRevision))
+			protected.Post("/set-emojis", protectedWithPrivilege(Moderator, setEmojis))
+
+			protected.Get("/privilegs-users/get-list", protectedWithPrivilege(Admin, getPrivilegeUsersList))
+			protected.Post("/privilegs-users/set", protectedWithPrivilege(Admin, setPrivilegeUsers))
+			protected.Post("/channel-privileges/set", protectedWithPrivilege(Admin, setChannelPrivileges))
+			protected.Post("/channels/create", protectedWithPrivilege(Admin, createChannel))
+			protected.Get("/settings/get", protectedWithPrivilege(Admin, getSettings))
+			protected.Post("/settings/set", protectedWithPrivilege(Admin, setSettings))
+			protected.Get("/retention/dry-run", protectedWithPrivilege(Admin, getRetentionDryRun))
+			protected.Get("/message-analytics/{id}", protectedWithPrivilege(Admin, getMessageAnalytics))
+			protected.Get("/api-keys/get-list", protectedWithPrivilege(Admin, getApiKeys))
+			protected.Post("/api-keys/create", protectedWithPrivilege(Admin, createApiKey))
+			protected.Post("/api-keys/revoke", protectedWithPrivilege(Admin, revokeApiKey))
+			protected.Post("/api-keys/rotate", protectedWithPrivilege(Admin, rotateApiKey))
+			protected.Post("/trash/purge", protectedWithPrivilege(Admin, purgeMessage))
+			protected.Post("/import/telegram", protectedWithPrivilege(Admin, importTelegramExport))
+			protected.Get("/import/telegram/status", protectedWithPrivilege(Admin, getTelegramImportStatus))
+			protected.Get("/export", protectedWithPrivilege(Admin, exportChannel))
+			protected.Post("/archive/generate", protectedWithPrivilege(Admin, generateArchiveHandler))
+			protected.Get("/reports/get", protectedWithPrivilege(Admin, getReports))
+			protected.Post("/reports/set", protectedWithPrivilege(Admin, setReports))
+
+			protected.Post("/block-user", protectedWithPrivilege(Admin, blockUser))
+			protected.Post("/unblock-user", protectedWithPrivilege(Admin, unblockUser))
+			protected.Get("/blocked-users/get-list", protectedWithPrivilege(Admin, getBlockedUsers))
+			protected.Get("/user-block-status", protectedWithPrivilege(Admin, getUserBlockStatus))
+
+			// temporary
+			protected.Get("/users/get-list", protectedWithPrivilege(Admin, getAllUsers))
+		})
+	})
+}
+
 func serveSpaFile(w http.ResponseWriter, r *http.Request) {
 	htmlPath := filepath.Join(settingConfig.RootStaticFolder, "index.html")
 	content, err := os.ReadFile(htmlPath)
@@ -30,6 +30,7 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 		limit = 20
 	}
 
+	channelId := channelIdFromRequest(r)
 	isAuthenticated := false
 	isAdmin := false
 	isModerator := false
@@ -40,12 +41,17 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 		if userSession, ok := session.Values["user"].(Session); ok {
 			isAuthenticated = true
 			isAdmin = userSession.Privileges[Admin]
-			isModerator = userSession.Privileges[Moderator]
+			isModerator = userSession.HasPrivilege(channelId, Moderator)
 			userId = userSession.ID
 		}
 	}
 
-	response, err := funcGetMessageRange(ctx, int64(offset), int64(limit), isAdmin, settingConfig.CountViews, isAuthenticated, isModerator, direction)
+	timeSetKey := timesKey(channelId)
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		timeSetKey = tagKey(channelId, normalizeHashtag(tag))
+	}
+
+	response, err := funcGetMessageRangeFromSet(ctx, channelId, timeSetKey, int64(offset), int64(limit), isAdmin, channelSettings(channelId).CountViews, isAuthenticated, isModerator, direction)
 	if err != nil {
 		log.Printf("Failed to get messages: %v\n", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -55,7 +61,7 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 
-	addViewsToMessages(ctx, response.Messages, userId)
+	addViewsToMessages(ctx, channelId, response.Messages, userId)
 }
 
 func getThreadRepliesHandler(w http.ResponseWriter, r *http.Request) {
@@ -69,6 +75,12 @@ func getThreadRepliesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !messageInChannel(ctx, r, messageId) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	channelId := channelIdFromRequest(r)
 	isAuthenticated := false
 	isAdmin := false
 	isModerator := false
@@ -78,12 +90,12 @@ func getThreadRepliesHandler(w http.ResponseWriter, r *http.Request) {
 		if userSession, ok := session.Values["user"].(Session); ok {
 			isAuthenticated = true
 			isAdmin = userSession.Privileges[Admin]
-			isModerator = userSession.Privileges[Moderator]
+			isModerator = userSession.HasPrivilege(channelId, Moderator)
 			userId = userSession.ID
 		}
 	}
 
-	replies, err := funcGetThreadReplies(ctx, messageId, isAdmin, settingConfig.CountViews, isAuthenticated, isModerator)
+	replies, err := funcGetThreadReplies(ctx, channelId, messageId, isAdmin, channelSettings(channelId).CountViews, isAuthenticated, isModerator)
 	if err != nil {
 		log.Printf("Failed to get thread replies: %v\n", err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -93,73 +105,39 @@ func getThreadRepliesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(replies)
 
-	addViewsToMessages(ctx, replies, userId)
+	addViewsToMessages(ctx, channelId, replies, userId)
 }
 
 func addMessage(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var message Message
-	var err error
 	defer r.Body.Close()
 
 	session, _ := store.Get(r, cookieName)
 	user, _ := session.Values["user"].(Session)
 
 	body := Message{}
-	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		log.Printf("Failed to decode message: %v\n", err)
 		http.Error(w, "error", http.StatusBadRequest)
 		return
 	}
 
-	if body.IsThread && !settingConfig.ThreadsEnabled {
-		http.Error(w, "Threads are disabled", http.StatusForbidden)
-		return
-	}
-
-	for _, regex := range settingConfig.RegexReplace {
-		t := regex.Pattern.ReplaceAllString(body.Text, regex.Replace)
-		body.Text = t
-	}
-
-	if settingConfig.MessageSignature != "" {
-		body.Text = body.Text + "\n\n---\n" + settingConfig.MessageSignature
-	}
-
-	if body.ReplyTo > 0 {
-		replyToKey := fmt.Sprintf("messages:%d", body.ReplyTo)
-		exists, err := rdb.Exists(ctx, replyToKey).Result()
-		if err != nil || exists == 0 {
-			log.Printf("Referenced message %d does not exist", body.ReplyTo)
-			http.Error(w, "Referenced message not found", http.StatusBadRequest)
-			return
-		}
-	}
-
-	message.ID = getMessageNextId(ctx)
-	message.Type = body.Type
-	message.Author = user.PublicName
-	message.AuthorId = user.ID
-	message.Timestamp = time.Now()
-	message.Text = body.Text
-	message.File = body.File
-	message.Views = 0
-	message.ReplyTo = body.ReplyTo
-	message.IsThread = body.IsThread
-
-	if err = setMessage(ctx, message, false); err != nil {
-		log.Printf("Failed to set new message: %v\n", err)
-		http.Error(w, "error", http.StatusInternalServerError)
-		return
-	}
-
-	go SendWebhook(context.Background(), "create", message)
-	go pushFcmMessage(message)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(message)
+	post, err := createPost(ctx, NewPost{
+		ChannelId: channelIdFromRequest(r),
+		Source:    PostSourceWriter,
+		User:      &user,
+		Author:    user.PublicName,
+		Type:      body.Type,
+		Text:      body.Text,
+		File:      body.File,
+		ReplyTo:   body.ReplyTo,
+		IsThread:  body.IsThread,
+		Poll:      body.Poll,
+		PublishAt: body.PublishAt,
+	})
+	writeCreatedPost(w, post, err)
 }
 
 func updateMessage(w http.ResponseWriter, r *http.Request) {
@@ -184,8 +162,7 @@ func updateMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	messageKey := fmt.Sprintf("messages:%d", body.ID)
-	exists, err := rdb.Exists(ctx, messageKey).Result()
-	if err != nil || exists == 0 {
+	if !messageInChannel(ctx, r, body.ID) {
 		http.Error(w, "Message not found", http.StatusNotFound)
 		return
 	}
@@ -196,9 +173,10 @@ func updateMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	channelId := channelIdFromRequest(r)
 	originalAuthorId := originalMessage["authorId"]
 	isAdmin := user.Privileges[Admin]
-	isModerator := user.Privileges[Moderator]
+	isModerator := user.HasPrivilege(channelId, Moderator)
 	isOwner := originalAuthorId == user.ID
 
 	if !isAdmin && !isModerator {
@@ -207,7 +185,7 @@ func updateMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if !user.Privileges[Writer] {
+		if !user.HasPrivilege(channelId, Writer) {
 			http.Error(w, "Writer privilege required to edit messages", http.StatusForbidden)
 			return
 		}
@@ -225,12 +203,30 @@ func updateMessage(w http.ResponseWriter, r *http.Request) {
 		}
 
 		elapsedTime := time.Since(timestamp).Seconds()
-		if elapsedTime > float64(settingConfig.EditTimeLimit) {
+		if elapsedTime > float64(channelSettings(channelId).EditTimeLimit) {
 			http.Error(w, "Edit time limit exceeded", http.StatusForbidden)
 			return
 		}
 	}
 
+	if body.Poll != nil {
+		locked, err := pollOptionsLocked(ctx, body.ID, originalMessage, body.Poll)
+		if err != nil {
+			http.Error(w, "Failed to check poll votes", http.StatusInternalServerError)
+			return
+		}
+		if locked {
+			http.Error(w, "Poll options can't be changed after votes were cast", http.StatusConflict)
+			return
+		}
+	}
+
+	if err := dbAddMessageRevision(ctx, body.ID, newMessageRevision(originalMessage, user)); err != nil {
+		log.Printf("Failed to save revision of message %d: %v\n", body.ID, err)
+		http.Error(w, "Failed to save message revision", http.StatusInternalServerError)
+		return
+	}
+
 	body.LastEdit = time.Now()
 
 	if err := setMessage(ctx, body, true); err != nil {
@@ -240,6 +236,7 @@ func updateMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	go SendWebhook(context.Background(), "update", body)
+	go updateLinkPreviews(body.ID, channelIdFromRequest(r), body.Text)
 
 	response := Response{Success: true}
 	json.NewEncoder(w).Encode(response)
@@ -264,8 +261,7 @@ func deleteMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	messageKey := fmt.Sprintf("messages:%s", id)
-	exists, err := rdb.Exists(ctx, messageKey).Result()
-	if err != nil || exists == 0 {
+	if !messageInChannel(ctx, r, idInt) {
 		http.Error(w, "Message not found", http.StatusNotFound)
 		return
 	}
@@ -276,9 +272,10 @@ func deleteMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	channelId := channelIdFromRequest(r)
 	originalAuthorId := originalMessage["authorId"]
 	isAdmin := user.Privileges[Admin]
-	isModerator := user.Privileges[Moderator]
+	isModerator := user.HasPrivilege(channelId, Moderator)
 	isOwner := originalAuthorId == user.ID
 
 	if !isAdmin && !isModerator {
@@ -287,7 +284,7 @@ func deleteMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if !user.Privileges[Writer] {
+		if !user.HasPrivilege(channelId, Writer) {
 			http.Error(w, "Writer privilege required to delete messages", http.StatusForbidden)
 			return
 		}
@@ -305,7 +302,7 @@ func deleteMessage(w http.ResponseWriter, r *http.Request) {
 		}
 
 		elapsedTime := time.Since(timestamp).Seconds()
-		if elapsedTime > float64(settingConfig.EditTimeLimit) {
+		if elapsedTime > float64(channelSettings(channelId).EditTimeLimit) {
 			http.Error(w, "Delete time limit exceeded", http.StatusForbidden)
 			return
 		}
@@ -347,7 +344,7 @@ func getEvents(w http.ResponseWriter, r *http.Request) {
 	}
 	flusher.Flush()
 
-	pubsub := rdb.Subscribe(r.Context(), "events")
+	pubsub := rdb.Subscribe(r.Context(), eventsKey(channelIdFromRequest(r)))
 	defer pubsub.Close()
 
 	if _, err := pubsub.Receive(clientCtx); err != nil {
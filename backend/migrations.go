@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var messageKeyPattern = regexp.MustCompile(`^messages:\d+$`)
+
+func runMigrations() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	// Runs first, so the other migrations only see the per-channel layout
+	if err := migrateChannelKeys(ctx); err != nil {
+		log.Printf("Warning: failed to move keys to the default channel: %v", err)
+	}
+
+	if err := migrateThreadIndex(ctx); err != nil {
+		log.Printf("Warning: failed to build thread index: %v", err)
+	}
+
+	if err := migrateDeletedIndex(ctx); err != nil {
+		log.Printf("Warning: failed to build deleted messages index: %v", err)
+	}
+
+	if err := migrateTagIndex(ctx); err != nil {
+		log.Printf("Warning: failed to build tag index: %v", err)
+	}
+
+	if err := migrateApiSecretKey(ctx); err != nil {
+		log.Printf("Warning: failed to migrate the API secret key: %v", err)
+	}
+}
+
+// migrateThreadIndex builds the per-parent thread index for messages created
+// before it was maintained by setMessage.
+func migrateThreadIndex(ctx context.Context) error {
+	done, err := rdb.Exists(ctx, "migrations:thread_index").Result()
+	if err != nil {
+		return err
+	}
+	if done > 0 {
+		return nil
+	}
+
+	threadCounts := make(map[string]int64)
+
+	iter := rdb.Scan(ctx, 0, "messages:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		messageKey := iter.Val()
+		if !messageKeyPattern.MatchString(messageKey) {
+			continue
+		}
+
+		values, err := rdb.HMGet(ctx, messageKey, "is_thread", "reply_to", "deleted", "timestamp").Result()
+		if err != nil {
+			return err
+		}
+
+		isThread, _ := values[0].(string)
+		replyTo, _ := values[1].(string)
+		deleted, _ := values[2].(string)
+		timestampStr, _ := values[3].(string)
+
+		if isThread != "1" || replyTo == "" || replyTo == "0" {
+			continue
+		}
+
+		timestamp, _ := time.Parse(time.RFC3339, timestampStr)
+		threadKey := fmt.Sprintf("message:%s:thread", replyTo)
+		if err := rdb.ZAdd(ctx, threadKey, redis.Z{Score: float64(timestamp.Unix()), Member: messageKey}).Err(); err != nil {
+			return err
+		}
+
+		if _, ok := threadCounts[replyTo]; !ok {
+			threadCounts[replyTo] = 0
+		}
+		if deleted != "1" {
+			threadCounts[replyTo]++
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for parentId, count := range threadCounts {
+		if err := rdb.Set(ctx, fmt.Sprintf("message:%s:thread_count", parentId), count, 0).Err(); err != nil {
+			return err
+		}
+	}
+
+	if err := rdb.Set(ctx, "migrations:thread_index", time.Now(), 0).Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Built thread index for %d threads", len(threadCounts))
+	return nil
+}
+
+// migrateDeletedIndex adds messages deleted before the trash view existed to
+// m_deleted:1. Their deletion time is unknown, so the message time is used.
+func migrateDeletedIndex(ctx context.Context) error {
+	done, err := rdb.Exists(ctx, "migrations:deleted_index").Result()
+	if err != nil {
+		return err
+	}
+	if done > 0 {
+		return nil
+	}
+
+	count := 0
+
+	iter := rdb.Scan(ctx, 0, "messages:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		messageKey := iter.Val()
+		if !messageKeyPattern.MatchString(messageKey) {
+			continue
+		}
+
+		values, err := rdb.HMGet(ctx, messageKey, "deleted", "timestamp").Result()
+		if err != nil {
+			return err
+		}
+
+		deleted, _ := values[0].(string)
+		timestampStr, _ := values[1].(string)
+		if deleted != "1" {
+			continue
+		}
+
+		timestamp, _ := time.Parse(time.RFC3339, timestampStr)
+		if err := rdb.ZAdd(ctx, "m_deleted:1", redis.Z{Score: float64(timestamp.Unix()), Member: messageKey}).Err(); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	if err := rdb.Set(ctx, "migrations:deleted_index", time.Now(), 0).Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Added %d deleted messages to the trash index", count)
+	return nil
+}
+
+// migrateTagIndex indexes the hashtags of messages saved before setMessage
+// maintained the tag index.
+func migrateTagIndex(ctx context.Context) error {
+	done, err := rdb.Exists(ctx, "migrations:tag_index").Result()
+	if err != nil {
+		return err
+	}
+	if done > 0 {
+		return nil
+	}
+
+	count := 0
+
+	iter := rdb.Scan(ctx, 0, "messages:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		messageKey := iter.Val()
+		if !messageKeyPattern.MatchString(messageKey) {
+			continue
+		}
+
+		id, err := strconv.Atoi(strings.TrimPrefix(messageKey, "messages:"))
+		if err != nil {
+			continue
+		}
+
+		if err := dbReindexMessageTags(ctx, id); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	if err := rdb.Set(ctx, "migrations:tag_index", time.Now(), 0).Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Indexed hashtags of %d messages", count)
+	return nil
+}
+
+// migrateChannelKeys moves the keys of deployments from before multiple
+// channels existed to the default channel. Messages without a channel_id
+// already belong to it, so only the per-channel indexes are renamed.
+func migrateChannelKeys(ctx context.Context) error {
+	done, err := rdb.Exists(ctx, "migrations:channel_keys").Result()
+	if err != nil {
+		return err
+	}
+	if done > 0 {
+		return nil
+	}
+
+	renames := map[string]string{
+		"emojis:list":   emojisKey(defaultChannelId),
+		"subscriptions": subscriptionsKey(defaultChannelId),
+	}
+
+	count := 0
+	for oldKey, newKey := range renames {
+		renamed, err := rdb.RenameNX(ctx, oldKey, newKey).Result()
+		if err != nil {
+			if err == redis.Nil || strings.Contains(err.Error(), "no such key") {
+				continue
+			}
+			return err
+		}
+		if renamed {
+			count++
+		}
+	}
+
+	if err := rdb.Set(ctx, "migrations:channel_keys", time.Now(), 0).Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Moved %d keys to the default channel", count)
+	return nil
+}
+
+// migrateApiSecretKey turns the api_secret_key setting into the legacy API
+// key, so clients sending the old secret keep working until an admin
+// revokes it. The plain secret is removed from the settings.
+func migrateApiSecretKey(ctx context.Context) error {
+	done, err := rdb.Exists(ctx, "migrations:api_secret_key").Result()
+	if err != nil {
+		return err
+	}
+	if done > 0 {
+		return nil
+	}
+
+	settings, err := dbGetSettings(ctx)
+	if err != nil {
+		return err
+	}
+
+	secret := ""
+	kept := Settings{}
+	for _, setting := range settings {
+		if setting.Key == "api_secret_key" {
+			secret = setting.GetString()
+			continue
+		}
+		kept = append(kept, setting)
+	}
+
+	if secret != "" {
+		key := ApiKey{
+			Id:        legacyApiKeyId,
+			Name:      "api_secret_key",
+			Scopes:    apiScopes,
+			Hash:      hashApiSecret(secret),
+			CreatedAt: time.Now(),
+		}
+		if err := dbSaveApiKey(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	if len(kept) != len(settings) {
+		if err := dbSetSettings(ctx, &kept); err != nil {
+			return err
+		}
+		settingConfig = kept.ToConfig()
+	}
+
+	if err := rdb.Set(ctx, "migrations:api_secret_key", time.Now(), 0).Err(); err != nil {
+		return err
+	}
+
+	if secret != "" {
+		log.Printf("Moved api_secret_key to the legacy API key")
+	}
+	return nil
+}
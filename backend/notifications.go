@@ -215,7 +215,7 @@ func subscribeNotifications(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := addSubscription(req.Token); err != nil {
+	if err := addSubscription(channelIdFromRequest(r), req.Token); err != nil {
 		http.Error(w, "Failed to subscribe to notifications", http.StatusInternalServerError)
 		return
 	}
@@ -235,7 +235,7 @@ func pushFcmMessage(m Message) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	list, err := getSubcriptionsList()
+	list, err := getSubcriptionsList(m.ChannelId)
 	if err != nil {
 		log.Println("Failed to get subscription list:", err)
 		return
@@ -246,7 +246,7 @@ func pushFcmMessage(m Message) {
 		return
 	}
 
-	channelName, err := getChannelDetails(ctx)
+	channelName, err := getChannelDetails(ctx, m.ChannelId)
 	if err != nil {
 		log.Println("Failed to get channel details:", err)
 		return
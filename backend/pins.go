@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+func getPinnedMessages(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	channelId := channelIdFromRequest(r)
+	isAuthenticated := false
+	isAdmin := false
+	isModerator := false
+
+	session, err := store.Get(r, cookieName)
+	if err == nil {
+		if userSession, ok := session.Values["user"].(Session); ok {
+			isAuthenticated = true
+			isAdmin = userSession.Privileges[Admin]
+			isModerator = userSession.HasPrivilege(channelId, Moderator)
+		}
+	}
+
+	messages, err := dbGetPinnedMessages(ctx, channelId, isAdmin, isAuthenticated, isModerator)
+	if err != nil {
+		log.Printf("Failed to get pinned messages: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+func pinMessage(w http.ResponseWriter, r *http.Request) {
+	setMessagePinned(w, r, true)
+}
+
+func unpinMessage(w http.ResponseWriter, r *http.Request) {
+	setMessagePinned(w, r, false)
+}
+
+func setMessagePinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var req struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if !messageInChannel(ctx, r, req.ID) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	if err := dbSetMessagePinned(ctx, req.ID, pinned); err != nil {
+		log.Printf("Failed to set pinned state of message %d: %v\n", req.ID, err)
+		http.Error(w, "Failed to update message", http.StatusInternalServerError)
+		return
+	}
+
+	pushType := "pin-message"
+	if !pinned {
+		pushType = "unpin-message"
+	}
+	publishEvent(ctx, pushType, Message{ID: req.ID, Pinned: pinned})
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
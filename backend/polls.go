@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxPollOptions = 20
+
+type Poll struct {
+	Options        []string  `json:"options"`
+	MultipleChoice bool      `json:"multipleChoice"`
+	ClosesAt       time.Time `json:"closesAt,omitzero"`
+	Anonymous      bool      `json:"anonymous"`
+}
+
+func (p *Poll) MarshalBinary() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+func (p *Poll) IsClosed() bool {
+	return !p.ClosesAt.IsZero() && time.Now().After(p.ClosesAt)
+}
+
+type PollVoter struct {
+	Name string `json:"name"`
+}
+
+// PollResults is the vote summary stored on the message. Voters is keyed by
+// the option index and is only filled for polls that are not anonymous. It
+// is shown only to readers who may see the message author.
+type PollResults struct {
+	Counts      []int                  `json:"counts"`
+	TotalVoters int                    `json:"totalVoters"`
+	Voters      map[string][]PollVoter `json:"voters,omitempty"`
+}
+
+// PollVote is the vote of a single user, stored in message:{id}:poll_votes.
+type PollVote struct {
+	Options []int  `json:"options"`
+	Name    string `json:"name"`
+}
+
+func validatePoll(p *Poll) error {
+	if p == nil {
+		return errors.New("poll is missing")
+	}
+
+	if len(p.Options) < 2 || len(p.Options) > maxPollOptions {
+		return fmt.Errorf("poll must have between 2 and %d options", maxPollOptions)
+	}
+
+	for i, option := range p.Options {
+		p.Options[i] = strings.TrimSpace(option)
+		if p.Options[i] == "" {
+			return errors.New("poll options must not be empty")
+		}
+	}
+
+	if p.IsClosed() {
+		return errors.New("poll close time is in the past")
+	}
+
+	return nil
+}
+
+// pollOptionsLocked reports whether an edit would change the options of a
+// poll that has votes. Votes refer to the options by index, so the options
+// can't change once someone voted.
+func pollOptionsLocked(ctx context.Context, messageId int, original map[string]string, poll *Poll) (bool, error) {
+	var stored Poll
+	if original["poll"] == "" || json.Unmarshal([]byte(original["poll"]), &stored) != nil {
+		return false, nil
+	}
+
+	if slices.Equal(stored.Options, poll.Options) {
+		return false, nil
+	}
+
+	votes, err := rdb.HLen(ctx, fmt.Sprintf("message:%d:poll_votes", messageId)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return votes > 0, nil
+}
+
+func votePoll(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	var req struct {
+		MessageID int   `json:"messageId"`
+		Options   []int `json:"options"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	values, err := rdb.HMGet(ctx, fmt.Sprintf("messages:%d", req.MessageID), "type", "deleted", "poll").Result()
+	if err != nil || values[0] == nil || !messageInChannel(ctx, r, req.MessageID) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	messageType, _ := values[0].(string)
+	deleted, _ := values[1].(string)
+	pollStr, _ := values[2].(string)
+
+	var poll Poll
+	if messageType != "poll" || deleted == "1" || json.Unmarshal([]byte(pollStr), &poll) != nil {
+		http.Error(w, "Message is not an active poll", http.StatusBadRequest)
+		return
+	}
+
+	if poll.IsClosed() {
+		http.Error(w, "Poll is closed", http.StatusForbidden)
+		return
+	}
+
+	if len(req.Options) > 1 && !poll.MultipleChoice {
+		http.Error(w, "Poll allows a single choice", http.StatusBadRequest)
+		return
+	}
+
+	seen := make(map[int]bool)
+	for _, option := range req.Options {
+		if option < 0 || option >= len(poll.Options) || seen[option] {
+			http.Error(w, "Invalid poll option", http.StatusBadRequest)
+			return
+		}
+		seen[option] = true
+	}
+
+	// An empty list of options retracts the vote
+	vote := PollVote{Options: req.Options, Name: user.PublicName}
+	if err := dbSetPollVote(ctx, req.MessageID, user.ID, vote); err != nil {
+		log.Printf("Failed to set poll vote: %v\n", err)
+		http.Error(w, "Failed to set vote", http.StatusInternalServerError)
+		return
+	}
+
+	results, err := dbUpdatePollResults(ctx, req.MessageID, &poll)
+	if err != nil {
+		log.Printf("Failed to update poll results: %v\n", err)
+		http.Error(w, "Failed to set vote", http.StatusInternalServerError)
+		return
+	}
+
+	// The event reaches every reader of the channel, so it carries only the
+	// counts
+	publishEvent(ctx, "poll-vote", Message{
+		ID:          req.MessageID,
+		PollResults: &PollResults{Counts: results.Counts, TotalVoters: results.TotalVoters},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func getMyPollVote(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	messageId, err := strconv.Atoi(r.URL.Query().Get("messageId"))
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	vote, err := dbGetPollVote(ctx, messageId, user.ID)
+	if err != nil {
+		log.Printf("Failed to get poll vote: %v\n", err)
+		http.Error(w, "Failed to get vote", http.StatusInternalServerError)
+		return
+	}
+
+	if vote.Options == nil {
+		vote.Options = []int{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vote.Options)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	PostSourceWriter = "writer"
+	PostSourceApi    = "api"
+	// Imported posts are historical: an admin runs the import, so they
+	// skip the approval queue, and their text is kept as exported.
+	PostSourceImport = "import"
+)
+
+// The notifications of a published post, replaced in tests.
+var (
+	sendPostWebhook = SendWebhook
+	sendPostPush    = pushFcmMessage
+)
+
+type NewPost struct {
+	ID         int // allocated when 0, imports reserve theirs beforehand
+	ChannelId  int
+	Source     string
+	User       *Session // nil for API posts
+	Author     string
+	Type       string
+	Text       string
+	File       FileResponse
+	Files      []FileResponse
+	ReplyTo    int
+	IsThread   bool
+	Poll       *Poll
+	Timestamp  time.Time
+	LastEdit   time.Time
+	PublishAt  time.Time
+	ExternalId string
+	Silent     bool // no webhook, push notification or link previews
+}
+
+type CreatedPost struct {
+	Message Message
+	Pending *PendingMessage
+}
+
+type postError struct {
+	status  int
+	message string
+}
+
+func (e *postError) Error() string { return e.message }
+
+// createPost is the single way new posts are created, from the admin UI and
+// from the external API alike. It validates the post against the channel
+// settings, applies the text transforms and the signature, and then queues
+// it for approval, schedules it or publishes it with its notifications.
+func createPost(ctx context.Context, p NewPost) (CreatedPost, error) {
+	var result CreatedPost
+	config := channelSettings(p.ChannelId)
+
+	if p.IsThread && !config.ThreadsEnabled {
+		return result, &postError{http.StatusForbidden, "Threads are disabled"}
+	}
+
+	if p.Type == "poll" {
+		if err := validatePoll(p.Poll); err != nil {
+			return result, &postError{http.StatusBadRequest, err.Error()}
+		}
+	} else {
+		p.Poll = nil
+	}
+
+	if p.ReplyTo > 0 {
+		if !dbMessageInChannel(ctx, p.ChannelId, p.ReplyTo) {
+			log.Printf("Referenced message %d does not exist", p.ReplyTo)
+			return result, &postError{http.StatusBadRequest, "Referenced message not found"}
+		}
+	}
+
+	if p.Source != PostSourceImport {
+		for _, regex := range config.RegexReplace {
+			p.Text = regex.Pattern.ReplaceAllString(p.Text, regex.Replace)
+		}
+
+		if config.MessageSignature != "" {
+			p.Text = p.Text + "\n\n---\n" + config.MessageSignature
+		}
+	}
+
+	for _, file := range p.Files {
+		p.Text = embedFileInText(p.Text, file)
+	}
+
+	if p.ExternalId != "" {
+		reserved, err := dbReserveExternalId(ctx, p.ChannelId, p.ExternalId)
+		if err != nil {
+			return result, err
+		}
+		if !reserved {
+			return result, &postError{http.StatusConflict, "External id already exists"}
+		}
+	}
+
+	message := Message{
+		ID:         p.ID,
+		Type:       p.Type,
+		Author:     p.Author,
+		Timestamp:  p.Timestamp,
+		LastEdit:   p.LastEdit,
+		Text:       p.Text,
+		File:       p.File,
+		ReplyTo:    p.ReplyTo,
+		IsThread:   p.IsThread,
+		Poll:       p.Poll,
+		ChannelId:  p.ChannelId,
+		ExternalId: p.ExternalId,
+	}
+	if message.ID == 0 {
+		message.ID = getMessageNextId(ctx)
+	}
+	if p.User != nil {
+		message.AuthorId = p.User.ID
+	}
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+	if p.PublishAt.After(time.Now()) {
+		message.PublishAt = p.PublishAt
+	}
+	result.Message = message
+
+	err := savePost(ctx, &result, p)
+	if err != nil && p.ExternalId != "" {
+		dbReleaseExternalId(ctx, p.ChannelId, p.ExternalId)
+	}
+	return result, err
+}
+
+// savePost queues the message of a post for approval, schedules it or
+// publishes it. A queued or scheduled post holds on to its external id.
+func savePost(ctx context.Context, result *CreatedPost, p NewPost) error {
+	message := result.Message
+
+	if p.Source != PostSourceImport && requiresApproval(p.ChannelId, p.User) {
+		pending, err := dbSubmitPendingMessage(ctx, message, p.Source)
+		if err != nil {
+			return err
+		}
+		result.Pending = &pending
+	} else if !message.PublishAt.IsZero() {
+		if err := dbSetScheduledMessage(ctx, message); err != nil {
+			return err
+		}
+	} else {
+		return publishMessage(ctx, message, !p.Silent)
+	}
+
+	if message.ExternalId != "" {
+		return dbAssignExternalId(ctx, message)
+	}
+	return nil
+}
+
+// publishMessage saves a new message and, unless it is historical, notifies
+// about it. Direct, approved, scheduled and imported posts all go through it.
+func publishMessage(ctx context.Context, m Message, notify bool) error {
+	if err := setMessage(ctx, m, false); err != nil {
+		return err
+	}
+
+	if !notify {
+		return nil
+	}
+
+	go sendPostWebhook(context.Background(), "create", m)
+	go sendPostPush(m)
+	go updateLinkPreviews(m.ID, m.ChannelId, m.Text)
+
+	return nil
+}
+
+// writeCreatedPost responds to a post creating request: the message, or the
+// submission with 202 when it waits for approval.
+func writeCreatedPost(w http.ResponseWriter, post CreatedPost, err error) {
+	if err != nil {
+		var pe *postError
+		if errors.As(err, &pe) {
+			http.Error(w, pe.message, pe.status)
+			return
+		}
+
+		log.Printf("Failed to create message: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if post.Pending != nil {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(post.Pending)
+		return
+	}
+	json.NewEncoder(w).Encode(post.Message)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests run against the Redis of REDIS_ADDR, in a channel of their own.
+const postsTestChannelId = 990025
+
+var (
+	redisOnce sync.Once
+	redisErr  error
+)
+
+// requireRedis connects to the database once, and skips the test when it
+// isn't reachable.
+func requireRedis(t *testing.T) {
+	t.Helper()
+
+	redisOnce.Do(func() {
+		if redisErr = connectDB(); redisErr == nil {
+			redisErr = loadSettings()
+		}
+	})
+	if redisErr != nil {
+		t.Skipf("Redis is not reachable: %v", redisErr)
+	}
+}
+
+func TestCreatePost(t *testing.T) {
+	requireRedis(t)
+	ctx := context.Background()
+
+	webhooks := make(chan Message, 10)
+	pushes := make(chan Message, 10)
+	sendPostWebhook = func(ctx context.Context, action string, m Message) { webhooks <- m }
+	sendPostPush = func(m Message) { pushes <- m }
+	defer func() {
+		sendPostWebhook = SendWebhook
+		sendPostPush = pushFcmMessage
+	}()
+
+	var ids []int
+	t.Cleanup(func() {
+		for _, id := range ids {
+			rdb.Del(ctx, fmt.Sprintf("messages:%d", id), fmt.Sprintf("scheduled:%d", id), pendingKey(id))
+			rdb.ZRem(ctx, "scheduled:list", fmt.Sprintf("scheduled:%d", id))
+		}
+		rdb.Del(ctx, timesKey(postsTestChannelId), pendingListKey(postsTestChannelId), externalIdKey(postsTestChannelId, "posts-test"))
+		channelSettingConfigs.Delete(postsTestChannelId)
+	})
+
+	writer := &Session{ID: "posts-test-writer", PublicName: "Writer", Privileges: Privileges{Writer: true}}
+	fileURL := "/api/files/0123456789abcdef0123456789abcdef01234567"
+
+	tests := []struct {
+		name          string
+		config        SettingConfig
+		setup         func(t *testing.T)
+		post          NewPost
+		wantStatus    int
+		wantText      string
+		wantNotified  bool
+		wantScheduled bool
+	}{
+		{
+			name:         "writer publish",
+			post:         NewPost{Source: PostSourceWriter, User: writer, Type: "md", Text: "hello"},
+			wantStatus:   http.StatusOK,
+			wantText:     "hello",
+			wantNotified: true,
+		},
+		{
+			name:         "api publish",
+			post:         NewPost{Source: PostSourceApi, Type: "md", Text: "from api"},
+			wantStatus:   http.StatusOK,
+			wantText:     "from api",
+			wantNotified: true,
+		},
+		{
+			name: "api with files",
+			post: NewPost{Source: PostSourceApi, Type: "md", Text: "photos", Files: []FileResponse{
+				{URL: fileURL, FileType: "image"},
+			}},
+			wantStatus:   http.StatusOK,
+			wantText:     "photos\n[image-embedded#](" + fileURL + ")",
+			wantNotified: true,
+		},
+		{
+			name:       "approval queue",
+			config:     SettingConfig{RequireApproval: true},
+			post:       NewPost{Source: PostSourceApi, Type: "md", Text: "needs review"},
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:          "scheduled",
+			post:          NewPost{Source: PostSourceWriter, User: writer, Type: "md", Text: "later", PublishAt: time.Now().Add(time.Hour)},
+			wantStatus:    http.StatusOK,
+			wantScheduled: true,
+		},
+		{
+			name:       "threads disabled",
+			post:       NewPost{Source: PostSourceWriter, User: writer, Type: "md", Text: "reply", ReplyTo: 1, IsThread: true},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "bad reply",
+			post:       NewPost{Source: PostSourceWriter, User: writer, Type: "md", Text: "reply", ReplyTo: 1 << 30},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "duplicate external id",
+			setup: func(t *testing.T) {
+				m := Message{ID: getMessageNextId(ctx), ChannelId: postsTestChannelId, Type: "md", Text: "first", Timestamp: time.Now(), ExternalId: "posts-test"}
+				ids = append(ids, m.ID)
+				if err := setMessage(ctx, m, false); err != nil {
+					t.Fatal(err)
+				}
+			},
+			post:       NewPost{Source: PostSourceApi, Type: "md", Text: "second", ExternalId: "posts-test"},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name: "regex and signature applied once",
+			config: SettingConfig{
+				RegexReplace:     []*ReplaceRegex{{Pattern: regexp.MustCompile("colour"), Replace: "color"}},
+				MessageSignature: "The team",
+			},
+			post:         NewPost{Source: PostSourceWriter, User: writer, Type: "md", Text: "colour"},
+			wantStatus:   http.StatusOK,
+			wantText:     "color\n\n---\nThe team",
+			wantNotified: true,
+		},
+		{
+			name: "silent import",
+			config: SettingConfig{
+				RequireApproval:  true,
+				MessageSignature: "The team",
+			},
+			post:       NewPost{Source: PostSourceImport, Type: "md", Text: "from telegram", Timestamp: time.Now().AddDate(-1, 0, 0), Silent: true},
+			wantStatus: http.StatusOK,
+			wantText:   "from telegram",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			channelSettingConfigs.Store(postsTestChannelId, &config)
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+
+			tt.post.ChannelId = postsTestChannelId
+			post, err := createPost(ctx, tt.post)
+			if post.Message.ID != 0 {
+				ids = append(ids, post.Message.ID)
+			}
+
+			rec := httptest.NewRecorder()
+			writeCreatedPost(rec, post, err)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+
+			id := post.Message.ID
+			saved := dbMessageInChannel(ctx, postsTestChannelId, id)
+			_, scheduledErr := dbGetScheduledMessage(ctx, id)
+			switch {
+			case tt.wantStatus == http.StatusAccepted:
+				if _, err := dbGetPendingMessage(ctx, id); err != nil || saved {
+					t.Errorf("pending = %v, saved = %v, want a pending message only", err, saved)
+				}
+			case tt.wantScheduled:
+				if scheduledErr != nil || saved {
+					t.Errorf("scheduled = %v, saved = %v, want a scheduled message only", scheduledErr, saved)
+				}
+			case tt.wantText != "":
+				text, _ := rdb.HGet(ctx, fmt.Sprintf("messages:%d", id), "text").Result()
+				if text != tt.wantText {
+					t.Errorf("text = %q, want %q", text, tt.wantText)
+				}
+			}
+
+			if tt.wantNotified {
+				for _, ch := range []chan Message{webhooks, pushes} {
+					select {
+					case m := <-ch:
+						if m.ID != id {
+							t.Errorf("notified about %d, want %d", m.ID, id)
+						}
+					case <-time.After(2 * time.Second):
+						t.Fatal("no notification sent")
+					}
+				}
+				return
+			}
+
+			select {
+			case m := <-webhooks:
+				t.Errorf("unexpected webhook for %d", m.ID)
+			case m := <-pushes:
+				t.Errorf("unexpected push for %d", m.ID)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"log"
 	"net/http"
 	"slices"
+	"sync"
 	"time"
 )
 
@@ -14,22 +16,26 @@ func (r Reactions) MarshalBinary() ([]byte, error) {
 	return json.Marshal(r)
 }
 
-var emojis []string = []string{}
+// channelEmojis caches the allowed emojis of every channel by its id.
+var channelEmojis sync.Map
 
-func init() {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func getChannelEmojis(ctx context.Context, channelId int) []string {
+	if e, ok := channelEmojis.Load(channelId); ok {
+		return e.([]string)
+	}
 
-	e, err := dbGetEmojisList(ctx)
+	e, err := dbGetEmojisList(ctx, channelId)
 	if err != nil {
-		panic("Failed to load emojis list: " + err.Error())
+		log.Printf("Failed to load emojis list of channel %d: %v\n", channelId, err)
+		return []string{}
 	}
 
-	emojis = e
+	channelEmojis.Store(channelId, e)
+	return e
 }
 
-func isAllowedEmoji(emoji string) bool {
-	return slices.Contains(emojis, emoji)
+func isAllowedEmoji(ctx context.Context, channelId int, emoji string) bool {
+	return slices.Contains(getChannelEmojis(ctx, channelId), emoji)
 }
 
 func setReactions(w http.ResponseWriter, r *http.Request) {
@@ -46,14 +52,14 @@ func setReactions(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	if req.MessageID <= 0 || !isAllowedEmoji(req.Emoji) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if req.MessageID <= 0 || !messageInChannel(ctx, r, req.MessageID) || !isAllowedEmoji(ctx, channelIdFromRequest(r), req.Emoji) {
 		http.Error(w, "Invalid message ID or reactions", http.StatusBadRequest)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	if err := setReaction(ctx, req.MessageID, req.Emoji, userId); err != nil {
 		http.Error(w, "Failed to set reactions", http.StatusInternalServerError)
 		return
@@ -66,8 +72,11 @@ func setReactions(w http.ResponseWriter, r *http.Request) {
 }
 
 func getEmojisList(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(emojis)
+	json.NewEncoder(w).Encode(getChannelEmojis(ctx, channelIdFromRequest(r)))
 }
 
 func setEmojis(w http.ResponseWriter, r *http.Request) {
@@ -89,12 +98,13 @@ func setEmojis(w http.ResponseWriter, r *http.Request) {
 	//	return
 	// }
 
-	if err := dbSetEmojisList(ctx, req.Emojis); err != nil {
+	channelId := channelIdFromRequest(r)
+	if err := dbSetEmojisList(ctx, channelId, req.Emojis); err != nil {
 		http.Error(w, "Failed to set emojis", http.StatusInternalServerError)
 		return
 	}
 
-	emojis = req.Emojis
+	channelEmojis.Store(channelId, req.Emojis)
 
 	var res Response
 	res.Success = true
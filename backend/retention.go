@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	retentionInterval  = time.Hour
+	retentionBatchSize = 500
+)
+
+type RetentionCandidate struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Files     []string  `json:"files,omitempty"`
+	// Deleted messages are expired as well, without a second webhook
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+type RetentionReport struct {
+	RetentionDays int64                `json:"retentionDays"`
+	Cutoff        time.Time            `json:"cutoff"`
+	Total         int                  `json:"total"`
+	Messages      []RetentionCandidate `json:"messages"`
+}
+
+func runRetentionJob() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		applyRetentionPolicy()
+		<-ticker.C
+	}
+}
+
+func retentionCutoff(channelId int) time.Time {
+	return time.Now().AddDate(0, 0, -int(channelSettings(channelId).RetentionDays))
+}
+
+// findExpiredMessages returns the messages of the channel older than the
+// cutoff, reading up to limit entries of the time index from offset. It also
+// returns how many entries were read, so the caller can page past the ones
+// that can't be expired.
+func findExpiredMessages(ctx context.Context, channelId int, cutoff time.Time, offset int64, limit int64) ([]RetentionCandidate, int, error) {
+	messageKeys, err := rdb.ZRangeByScore(ctx, timesKey(channelId), &redis.ZRangeBy{
+		Min:    "-inf",
+		Max:    "(" + strconv.FormatInt(cutoff.Unix(), 10),
+		Offset: offset,
+		Count:  limit,
+	}).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	candidates := []RetentionCandidate{}
+	for _, messageKey := range messageKeys {
+		values, err := rdb.HMGet(ctx, messageKey, "id", "timestamp", "text", "deleted").Result()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		idStr, _ := values[0].(string)
+		timestampStr, _ := values[1].(string)
+		text, _ := values[2].(string)
+		deleted, _ := values[3].(string)
+
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			continue
+		}
+		timestamp, _ := time.Parse(time.RFC3339, timestampStr)
+
+		candidates = append(candidates, RetentionCandidate{
+			ID:        id,
+			Timestamp: timestamp,
+			Files:     extractFileIds(text),
+			Deleted:   deleted == "1",
+		})
+	}
+
+	return candidates, len(messageKeys), nil
+}
+
+// expiredByRetention reports whether a message is older than the channel's
+// retention cutoff.
+func expiredByRetention(ctx context.Context, channelId int, id int) bool {
+	if channelSettings(channelId).RetentionDays <= 0 {
+		return false
+	}
+
+	timestampStr, err := rdb.HGet(ctx, fmt.Sprintf("messages:%d", id), "timestamp").Result()
+	if err != nil {
+		return false
+	}
+	timestamp, err := time.Parse(time.RFC3339, timestampStr)
+	return err == nil && timestamp.Before(retentionCutoff(channelId))
+}
+
+// expireMessage deletes an expired message for good: it leaves the time
+// index and the trash, so it can't be restored without its files.
+func expireMessage(ctx context.Context, channelId int, c RetentionCandidate) error {
+	messageKey := fmt.Sprintf("messages:%d", c.ID)
+
+	if !c.Deleted {
+		if err := funcDeleteMessage(ctx, strconv.Itoa(c.ID)); err != nil {
+			return err
+		}
+	}
+
+	if err := rdb.ZRem(ctx, timesKey(channelId), messageKey).Err(); err != nil {
+		return err
+	}
+
+	rdb.ZRem(ctx, deletedKey(channelId), messageKey)
+	rdb.ZRem(ctx, pinnedKey(channelId), messageKey)
+	rdb.Del(ctx, fmt.Sprintf("message:%d:reactions", c.ID), fmt.Sprintf("message:%d:viewed_by", c.ID), fmt.Sprintf("message:%d:poll_votes", c.ID), analyticsKey(c.ID))
+
+	for _, fileId := range c.Files {
+		if err := markFileDeleted(fileId); err != nil {
+			log.Printf("Failed to mark file %s of message %d as deleted: %v\n", fileId, c.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func applyRetentionPolicy() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	channelIds, err := dbGetChannelIds(ctx)
+	if err != nil {
+		log.Printf("Failed to get channels for retention: %v\n", err)
+		return
+	}
+
+	for _, channelId := range channelIds {
+		applyChannelRetentionPolicy(ctx, channelId)
+	}
+}
+
+// applyChannelRetentionPolicy expires the channel's old messages batch by
+// batch, until none are left or the run's time is up.
+func applyChannelRetentionPolicy(ctx context.Context, channelId int) {
+	if channelSettings(channelId).RetentionDays <= 0 {
+		return
+	}
+
+	cutoff := retentionCutoff(channelId)
+	expired := 0
+	// Expired messages leave the time index, the skipped and failed ones
+	// stay and are paged over
+	var offset int64
+
+	for ctx.Err() == nil {
+		candidates, scanned, err := findExpiredMessages(ctx, channelId, cutoff, offset, retentionBatchSize)
+		if err != nil {
+			log.Printf("Failed to find expired messages of channel %d: %v\n", channelId, err)
+			break
+		}
+		if scanned == 0 {
+			break
+		}
+
+		batchExpired := 0
+		for _, c := range candidates {
+			if err := expireMessage(ctx, channelId, c); err != nil {
+				log.Printf("Failed to expire message %d: %v\n", c.ID, err)
+				continue
+			}
+			batchExpired++
+
+			if c.Deleted {
+				continue
+			}
+			go SendWebhook(context.Background(), "delete", Message{ID: c.ID, Deleted: true, ChannelId: channelId})
+		}
+
+		expired += batchExpired
+		offset += int64(scanned - batchExpired)
+	}
+
+	if expired > 0 {
+		log.Printf("Retention policy expired %d messages of channel %d", expired, channelId)
+	}
+}
+
+func getRetentionDryRun(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	channelId := channelIdFromRequest(r)
+	report := RetentionReport{
+		RetentionDays: channelSettings(channelId).RetentionDays,
+		Messages:      []RetentionCandidate{},
+	}
+
+	if report.RetentionDays > 0 {
+		report.Cutoff = retentionCutoff(channelId)
+
+		candidates, _, err := findExpiredMessages(ctx, channelId, report.Cutoff, 0, -1)
+		if err != nil {
+			log.Printf("Failed to find expired messages: %v\n", err)
+			http.Error(w, "Failed to find expired messages", http.StatusInternalServerError)
+			return
+		}
+		report.Messages = candidates
+		report.Total = len(candidates)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+type MessageRevision struct {
+	Revision   int       `json:"revision"`
+	Type       string    `json:"type"`
+	Text       string    `json:"text"`
+	EditedBy   string    `json:"editedBy"`
+	EditorName string    `json:"editorName"`
+	EditedAt   time.Time `json:"editedAt"`
+}
+
+// newMessageRevision keeps the content of a message as it was before an edit.
+func newMessageRevision(original map[string]string, user Session) MessageRevision {
+	return MessageRevision{
+		Type:       original["type"],
+		Text:       original["text"],
+		EditedBy:   user.ID,
+		EditorName: user.PublicName,
+		EditedAt:   time.Now(),
+	}
+}
+
+func getMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	if !messageInChannel(ctx, r, id) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	revisions, err := dbGetMessageRevisions(ctx, id)
+	if err != nil {
+		log.Printf("Failed to get revisions of message %d: %v\n", id, err)
+		http.Error(w, "Failed to get revisions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+func restoreMessageRevision(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user, ok := session.Values["user"].(Session)
+	if !ok {
+		http.Error(w, "User not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		MessageId int `json:"messageId"`
+		Revision  int `json:"revision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	messageKey := fmt.Sprintf("messages:%d", req.MessageId)
+	originalMessage, err := rdb.HGetAll(ctx, messageKey).Result()
+	if err != nil || len(originalMessage) == 0 || !messageInChannel(ctx, r, req.MessageId) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	if req.Revision <= 0 {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	revision, err := dbGetMessageRevision(ctx, req.MessageId, req.Revision)
+	if err != nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	// The current content becomes a revision too, so a rollback can be undone.
+	if err := dbAddMessageRevision(ctx, req.MessageId, newMessageRevision(originalMessage, user)); err != nil {
+		log.Printf("Failed to save revision of message %d: %v\n", req.MessageId, err)
+		http.Error(w, "Failed to restore revision", http.StatusInternalServerError)
+		return
+	}
+
+	if err := rdb.HSet(ctx, messageKey, "type", revision.Type, "text", revision.Text, "last_edit", time.Now()).Err(); err != nil {
+		http.Error(w, "Failed to restore revision", http.StatusInternalServerError)
+		return
+	}
+
+	if err := dbReindexMessageTags(ctx, req.MessageId); err != nil {
+		log.Printf("Failed to reindex tags of message %d: %v\n", req.MessageId, err)
+	}
+
+	data, err := rdb.HGetAll(ctx, messageKey).Result()
+	if err != nil {
+		http.Error(w, "Failed to restore revision", http.StatusInternalServerError)
+		return
+	}
+
+	message, err := parseMessageFromRedis(data, true, true, true)
+	if err != nil {
+		http.Error(w, "Failed to restore revision", http.StatusInternalServerError)
+		return
+	}
+
+	publishEvent(ctx, "edit-message", message)
+	go SendWebhook(context.Background(), "update", message)
+	go updateLinkPreviews(message.ID, message.ChannelId, message.Text)
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const schedulerInterval = 15 * time.Second
+
+func runScheduler() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		publishDueMessages()
+	}
+}
+
+func publishDueMessages() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dueKeys, err := rdb.ZRangeByScoreWithScores(ctx, "scheduled:list", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		log.Printf("Failed to get scheduled messages: %v\n", err)
+		return
+	}
+
+	for _, due := range dueKeys {
+		scheduledKey, _ := due.Member.(string)
+
+		// Claiming takes the entry off the list and deletes it at once, so a
+		// message is published only once even if several instances run the
+		// scheduler, and a reschedule or cancel can't race the publishing.
+		messageJSON, err := dbClaimScheduledMessage(ctx, scheduledKey)
+		if err != nil {
+			if err != redis.Nil {
+				log.Printf("Failed to claim scheduled message %s: %v\n", scheduledKey, err)
+			}
+			continue
+		}
+
+		var message Message
+		if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+			log.Printf("Failed to decode scheduled message %s: %v\n", scheduledKey, err)
+			restoreScheduledMessage(ctx, scheduledKey, messageJSON, due)
+			continue
+		}
+
+		message.Timestamp = time.Now()
+		message.PublishAt = time.Time{}
+		if message.ChannelId == 0 {
+			message.ChannelId = defaultChannelId
+		}
+
+		if err := publishMessage(ctx, message, true); err != nil {
+			log.Printf("Failed to publish scheduled message %d: %v\n", message.ID, err)
+			restoreScheduledMessage(ctx, scheduledKey, messageJSON, due)
+		}
+	}
+}
+
+// restoreScheduledMessage puts a claimed message back on the schedule, so
+// the next run retries it.
+func restoreScheduledMessage(ctx context.Context, scheduledKey string, messageJSON string, due redis.Z) {
+	if err := rdb.Set(ctx, scheduledKey, messageJSON, 0).Err(); err != nil {
+		log.Printf("Failed to restore scheduled message %s: %v\n", scheduledKey, err)
+		return
+	}
+	rdb.ZAdd(ctx, "scheduled:list", due)
+}
+
+func canManageScheduledMessage(user Session, channelId int, m Message) bool {
+	// Messages scheduled before channels existed belong to the default one
+	messageChannelId := m.ChannelId
+	if messageChannelId == 0 {
+		messageChannelId = defaultChannelId
+	}
+	if messageChannelId != channelId {
+		return false
+	}
+
+	return user.Privileges[Admin] || user.HasPrivilege(channelId, Moderator) || m.AuthorId == user.ID
+}
+
+func getScheduledMessages(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user, ok := session.Values["user"].(Session)
+	if !ok {
+		http.Error(w, "User not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	messages, err := dbGetScheduledMessages(ctx)
+	if err != nil {
+		log.Printf("Failed to get scheduled messages: %v\n", err)
+		http.Error(w, "Failed to get scheduled messages", http.StatusInternalServerError)
+		return
+	}
+
+	filteredMessages := []Message{}
+	for _, m := range messages {
+		if canManageScheduledMessage(user, channelIdFromRequest(r), m) {
+			filteredMessages = append(filteredMessages, m)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filteredMessages)
+}
+
+func rescheduleMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user, ok := session.Values["user"].(Session)
+	if !ok {
+		http.Error(w, "User not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ID        int       `json:"id"`
+		PublishAt time.Time `json:"publishAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if !req.PublishAt.After(time.Now()) {
+		http.Error(w, "Publish time must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	m, err := dbGetScheduledMessage(ctx, req.ID)
+	if err != nil {
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+		return
+	}
+
+	if !canManageScheduledMessage(user, channelIdFromRequest(r), m) {
+		http.Error(w, "You can only reschedule your own messages", http.StatusForbidden)
+		return
+	}
+
+	m.PublishAt = req.PublishAt
+	if err := dbUpdateScheduledMessage(ctx, m); err != nil {
+		if err == redis.Nil {
+			http.Error(w, "Scheduled message not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to reschedule message", http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func cancelScheduledMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user, ok := session.Values["user"].(Session)
+	if !ok {
+		http.Error(w, "User not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	m, err := dbGetScheduledMessage(ctx, req.ID)
+	if err != nil {
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+		return
+	}
+
+	if !canManageScheduledMessage(user, channelIdFromRequest(r), m) {
+		http.Error(w, "You can only cancel your own messages", http.StatusForbidden)
+		return
+	}
+
+	if err := dbDeleteScheduledMessage(ctx, req.ID); err != nil {
+		if err == redis.Nil {
+			http.Error(w, "Scheduled message not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to cancel scheduled message", http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -186,7 +186,7 @@ func processMessagesParallel(ctx context.Context, keys []string, queryWords []st
 	return matched
 }
 
-func searchMessagesSimple(ctx context.Context, query string, limit, offset int, isAdmin, isAuthenticated, isModerator bool, daysBack int) ([]Message, int, error) {
+func searchMessagesSimple(ctx context.Context, channelId int, query string, limit, offset int, isAdmin, isAuthenticated, isModerator bool, daysBack int) ([]Message, int, error) {
 	normalizedQuery := normalizeText(query)
 	if normalizedQuery == "" {
 		return []Message{}, 0, fmt.Errorf("שאילתת חיפוש ריקה")
@@ -199,7 +199,7 @@ func searchMessagesSimple(ctx context.Context, query string, limit, offset int,
 
 	minTimestamp := time.Now().AddDate(0, 0, -daysBack).Unix()
 
-	messageKeys, err := rdb.ZRevRangeByScore(ctx, "m_times:1", &redis.ZRangeBy{
+	messageKeys, err := rdb.ZRevRangeByScore(ctx, timesKey(channelId), &redis.ZRangeBy{
 		Min: fmt.Sprintf("%d", minTimestamp),
 		Max: "+inf",
 	}).Result()
@@ -226,7 +226,7 @@ func searchMessagesSimple(ctx context.Context, query string, limit, offset int,
 	return matchedMessages[start:end], total, nil
 }
 
-func searchMessagesAdvanced(ctx context.Context, pattern string, limit, offset int, isAdmin, isAuthenticated, isModerator bool, daysBack int) ([]Message, int, error) {
+func searchMessagesAdvanced(ctx context.Context, channelId int, pattern string, limit, offset int, isAdmin, isAuthenticated, isModerator bool, daysBack int) ([]Message, int, error) {
 	if len(pattern) > 500 {
 		return []Message{}, 0, fmt.Errorf("ביטוי רגולרי ארוך מדי (מקסימום 500 תווים)")
 	}
@@ -242,7 +242,7 @@ func searchMessagesAdvanced(ctx context.Context, pattern string, limit, offset i
 
 	minTimestamp := time.Now().AddDate(0, 0, -daysBack).Unix()
 
-	messageKeys, err := rdb.ZRevRangeByScore(ctx, "m_times:1", &redis.ZRangeBy{
+	messageKeys, err := rdb.ZRevRangeByScore(ctx, timesKey(channelId), &redis.ZRangeBy{
 		Min: fmt.Sprintf("%d", minTimestamp),
 		Max: "+inf",
 	}).Result()
@@ -414,6 +414,7 @@ func matchWithTimeout(regex *regexp.Regexp, text, author string, timeout time.Du
 
 func parseMessageFromRedis(data map[string]string, isAdmin, isAuthenticated, isModerator bool) (Message, error) {
 	var message Message
+	config := channelSettings(channelIdFromData(data))
 
 	if idStr, ok := data["id"]; ok {
 		id, err := strconv.Atoi(idStr)
@@ -426,10 +427,8 @@ func parseMessageFromRedis(data map[string]string, isAdmin, isAuthenticated, isM
 	message.Type = data["type"]
 	message.Text = data["text"]
 
-	if isAdmin || isModerator {
-		message.Author = data["author"]
-		message.AuthorId = data["authorId"]
-	} else if settingConfig.ShowAuthorToAuthenticated && isAuthenticated {
+	showAuthor := isAdmin || isModerator || (config.ShowAuthorToAuthenticated && isAuthenticated)
+	if showAuthor {
 		message.Author = data["author"]
 		message.AuthorId = data["authorId"]
 	} else {
@@ -442,7 +441,7 @@ func parseMessageFromRedis(data map[string]string, isAdmin, isAuthenticated, isM
 		message.Timestamp = timestamp
 	}
 
-	if !settingConfig.HideEditTime {
+	if !config.HideEditTime {
 		if le, ok := data["last_edit"]; ok && le != "" {
 			lastEdit, _ := time.Parse(time.RFC3339, le)
 			message.LastEdit = lastEdit
@@ -451,7 +450,7 @@ func parseMessageFromRedis(data map[string]string, isAdmin, isAuthenticated, isM
 
 	message.Deleted = data["deleted"] == "1"
 
-	if settingConfig.CountViews && (!settingConfig.HideCountViewsForUsers || isAdmin || isModerator) {
+	if config.CountViews && (!config.HideCountViewsForUsers || isAdmin || isModerator) {
 		if viewsStr, ok := data["views"]; ok {
 			views, _ := strconv.Atoi(viewsStr)
 			message.Views = views
@@ -464,12 +463,39 @@ func parseMessageFromRedis(data map[string]string, isAdmin, isAuthenticated, isM
 		message.Reactions = reactions
 	}
 
+	if pollStr, ok := data["poll"]; ok && pollStr != "" {
+		var poll Poll
+		if err := json.Unmarshal([]byte(pollStr), &poll); err == nil {
+			message.Poll = &poll
+		}
+	}
+
+	if resultsStr, ok := data["poll_results"]; ok && resultsStr != "" {
+		var results PollResults
+		if err := json.Unmarshal([]byte(resultsStr), &results); err == nil {
+			// Voters are shown to whoever may see the author
+			if !showAuthor {
+				results.Voters = nil
+			}
+			message.PollResults = &results
+		}
+	}
+
+	if previewsStr, ok := data["link_previews"]; ok && previewsStr != "" {
+		var previews []LinkPreview
+		if err := json.Unmarshal([]byte(previewsStr), &previews); err == nil {
+			message.LinkPreviews = previews
+		}
+	}
+
 	if replyToStr, ok := data["reply_to"]; ok && replyToStr != "" && replyToStr != "0" {
 		replyTo, _ := strconv.Atoi(replyToStr)
 		message.ReplyTo = replyTo
 	}
 
 	message.IsThread = data["is_thread"] == "1"
+	message.Pinned = data["pinned"] == "1"
+	message.ChannelId = channelIdFromData(data)
 
 	return message, nil
 }
@@ -541,18 +567,19 @@ func searchMessages(w http.ResponseWriter, r *http.Request) {
 		req.DaysBack = 1095
 	}
 
+	channelId := channelIdFromRequest(r)
 	isAdmin := userSession.Privileges[Admin]
 	isAuthenticated := true
-	isModerator := userSession.Privileges[Moderator]
+	isModerator := userSession.HasPrivilege(channelId, Moderator)
 
 	var results []Message
 	var total int
 
 	switch req.Mode {
 	case "simple":
-		results, total, err = searchMessagesSimple(ctx, req.Query, req.Limit, req.Offset, isAdmin, isAuthenticated, isModerator, req.DaysBack)
+		results, total, err = searchMessagesSimple(ctx, channelId, req.Query, req.Limit, req.Offset, isAdmin, isAuthenticated, isModerator, req.DaysBack)
 	case "advanced":
-		results, total, err = searchMessagesAdvanced(ctx, req.Query, req.Limit, req.Offset, isAdmin, isAuthenticated, isModerator, req.DaysBack)
+		results, total, err = searchMessagesAdvanced(ctx, channelId, req.Query, req.Limit, req.Offset, isAdmin, isAuthenticated, isModerator, req.DaysBack)
 	}
 
 	if err != nil {
@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"net/netip"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -28,7 +30,6 @@ type SettingConfig struct {
 	RegexReplace                []*ReplaceRegex
 	WebhookURL                  string
 	VerifyToken                 string
-	ApiSecretKey                string
 	RootStaticFolder            string
 	CountViews                  bool
 	HideCountViewsForUsers      bool
@@ -61,6 +62,13 @@ type SettingConfig struct {
 	GoogleChatWebhookEnabled    bool
 	GoogleChatWebhookURL        string
 	GoogleChatWebhookBaseURL    string
+	RetentionDays               int64
+	ArchivePath                 string
+	AnalyticsHourlyDays         int64
+	LinkPreviews                bool
+	RequireApproval             bool
+	IdempotencyWindowHours      int64
+	TrustedProxies              []netip.Prefix
 }
 
 type Setting struct {
@@ -70,18 +78,44 @@ type Setting struct {
 
 var settingConfig *SettingConfig
 
+// channelSettingKeys are the settings a channel can override. The others
+// apply to the whole deployment and are only read from the global settings.
+var channelSettingKeys = []string{
+	"ad-iframe-src",
+	"ad-iframe-width",
+	"ad-iframe-margin",
+	"require_auth",
+	"count_views",
+	"hide_count_views_for_users",
+	"show_author_to_authenticated",
+	"hide_edit_time",
+	"google_analytics_id",
+	"regex-replace",
+	"message_signature",
+	"edit_time_limit",
+	"contact_us",
+	"threads_enabled",
+	"hide_member_count_for_non_admins",
+	"retention_days",
+	"link_previews",
+	"require_approval",
+}
+
 type Settings []Setting
 
-func init() {
+// loadSettings loads the deployment settings, once the database is
+// connected.
+func loadSettings() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	s, err := dbGetSettings(ctx)
 	if err != nil {
-		panic("Failed to load settings from database: " + err.Error())
+		return err
 	}
 
 	settingConfig = s.ToConfig()
+	return nil
 }
 
 func (s *Settings) ToConfig() *SettingConfig {
@@ -99,6 +133,8 @@ func (s *Settings) ToConfig() *SettingConfig {
 	config.ThreadsEnabled = false
 	config.MessageSignature = ""
 	config.AllowOnlyExistingUsers = false
+	config.AnalyticsHourlyDays = 7
+	config.IdempotencyWindowHours = 24
 
 	// Load API file upload settings from ENV only
 	if allowUpload := os.Getenv("ALLOW_API_FILE_UPLOAD"); allowUpload == "true" {
@@ -147,9 +183,6 @@ func (s *Settings) ToConfig() *SettingConfig {
 		case "webhook_verify_token":
 			config.VerifyToken = setting.GetString()
 
-		case "api_secret_key":
-			config.ApiSecretKey = setting.GetString()
-
 		case "count_views":
 			config.CountViews = setting.GetBool()
 
@@ -293,6 +326,40 @@ func (s *Settings) ToConfig() *SettingConfig {
 
 		case "google_chat_webhook_base_url":
 			config.GoogleChatWebhookBaseURL = setting.GetString()
+
+		case "archive_path":
+			config.ArchivePath = setting.GetString()
+
+		case "retention_days":
+			if days := setting.GetInt(); days > 0 {
+				config.RetentionDays = days
+			}
+
+		case "idempotency_window_hours":
+			if hours := setting.GetInt(); hours > 0 {
+				config.IdempotencyWindowHours = hours
+			}
+
+		case "trusted_proxies":
+			for _, proxy := range strings.Split(setting.GetString(), ",") {
+				proxy = strings.TrimSpace(proxy)
+				if prefix, err := netip.ParsePrefix(proxy); err == nil {
+					config.TrustedProxies = append(config.TrustedProxies, prefix.Masked())
+				} else if addr, err := netip.ParseAddr(proxy); err == nil {
+					config.TrustedProxies = append(config.TrustedProxies, netip.PrefixFrom(addr, addr.BitLen()))
+				}
+			}
+
+		case "require_approval":
+			config.RequireApproval = setting.GetBool()
+
+		case "link_previews":
+			config.LinkPreviews = setting.GetBool()
+
+		case "analytics_hourly_days":
+			if days := setting.GetInt(); days > 0 {
+				config.AnalyticsHourlyDays = days
+			}
 		}
 	}
 
@@ -334,12 +401,36 @@ func setSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Under a channel route only that channel's overrides are saved
+	if channelId := channelIdFromRequest(r); channelId != defaultChannelId {
+		overrides := Settings{}
+		for _, setting := range newSettings {
+			if slices.Contains(channelSettingKeys, setting.Key) {
+				overrides = append(overrides, setting)
+			}
+		}
+
+		if err := dbSetChannelSettings(ctx, channelId, &overrides); err != nil {
+			http.Error(w, "error saving settings", http.StatusInternalServerError)
+			return
+		}
+
+		res := Response{
+			Success: true,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
 	if err := dbSetSettings(ctx, &newSettings); err != nil {
 		http.Error(w, "error saving settings", http.StatusInternalServerError)
 		return
 	}
 
 	settingConfig = newSettings.ToConfig()
+	// The other channels inherit what they don't override
+	channelSettingConfigs.Clear()
 
 	res := Response{
 		Success: true,
@@ -352,7 +443,13 @@ func getSettings(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	s, err := dbGetSettings(ctx)
+	var s Settings
+	var err error
+	if channelId := channelIdFromRequest(r); channelId != defaultChannelId {
+		s, err = dbGetChannelSettings(ctx, channelId)
+	} else {
+		s, err = dbGetSettings(ctx)
+	}
 	if err != nil {
 		http.Error(w, "error getting settings", http.StatusInternalServerError)
 		return
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// hashtagPattern matches #tag at the start of the text or after a character
+// that cannot be part of a word or a URL, so anchors like page#section and
+// HTML entities like &#39; are not taken as tags.
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&/#])#([\p{L}\p{N}_]+)`)
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+}
+
+func normalizeHashtag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+}
+
+// extractHashtags returns the distinct tags of a text, normalized. Tags made
+// only of digits (#1) are ignored.
+func extractHashtags(text string) []string {
+	var tags []string
+
+	for _, match := range hashtagPattern.FindAllStringSubmatch(text, -1) {
+		tag := normalizeHashtag(match[1])
+		if !strings.ContainsFunc(tag, unicode.IsLetter) {
+			continue
+		}
+
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+func getTags(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tags, err := dbGetTags(ctx, channelIdFromRequest(r))
+	if err != nil {
+		log.Printf("Failed to get tags: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
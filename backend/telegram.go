@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rootImportPath is where Telegram Desktop exports are placed before
+// importing them, IMPORT_PATH or /app/import/. Each export is a folder with
+// result.json and its media.
+var rootImportPath = importPathFromEnv()
+
+const telegramImportTimeout = 30 * time.Minute
+
+func importPathFromEnv() string {
+	if path := os.Getenv("IMPORT_PATH"); path != "" {
+		return path
+	}
+	return "/app/import/"
+}
+
+type TelegramExport struct {
+	Name     string            `json:"name"`
+	ID       int64             `json:"id"`
+	Messages []TelegramMessage `json:"messages"`
+}
+
+type TelegramMessage struct {
+	ID               int              `json:"id"`
+	Type             string           `json:"type"`
+	Date             string           `json:"date"`
+	DateUnixtime     string           `json:"date_unixtime"`
+	EditedUnixtime   string           `json:"edited_unixtime"`
+	From             string           `json:"from"`
+	Text             json.RawMessage  `json:"text"`
+	TextEntities     []TelegramEntity `json:"text_entities"`
+	Photo            string           `json:"photo"`
+	File             string           `json:"file"`
+	MediaType        string           `json:"media_type"`
+	ReplyToMessageID int              `json:"reply_to_message_id"`
+}
+
+type TelegramEntity struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Href     string `json:"href"`
+	Language string `json:"language"`
+}
+
+type TelegramImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+	Failed   int `json:"failed"`
+}
+
+const (
+	TelegramImportRunning = "running"
+	TelegramImportDone    = "done"
+	TelegramImportFailed  = "failed"
+)
+
+// TelegramImportStatus is the state of the last import of a channel, kept in
+// import:telegram:status:{channelId}.
+type TelegramImportStatus struct {
+	Status     string    `json:"status"`
+	Folder     string    `json:"folder"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	TelegramImportResult
+}
+
+func telegramImportStatusKey(channelId int) string {
+	return fmt.Sprintf("import:telegram:status:%d", channelId)
+}
+
+func telegramImportLockKey(channelId int) string {
+	return fmt.Sprintf("import:telegram:lock:%d", channelId)
+}
+
+func dbSetTelegramImportStatus(ctx context.Context, channelId int, status TelegramImportStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(ctx, telegramImportStatusKey(channelId), data, 0).Err()
+}
+
+func dbGetTelegramImportStatus(ctx context.Context, channelId int) (TelegramImportStatus, error) {
+	var status TelegramImportStatus
+
+	data, err := rdb.Get(ctx, telegramImportStatusKey(channelId)).Result()
+	if err != nil {
+		return status, err
+	}
+
+	err = json.Unmarshal([]byte(data), &status)
+	return status, err
+}
+
+func importTelegramExport(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Folder string `json:"folder"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	exportDir, err := resolveImportPath(rootImportPath, req.Folder)
+	if err != nil || req.Folder == "" {
+		http.Error(w, "Invalid import folder", http.StatusBadRequest)
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(exportDir, "result.json"))
+	if err != nil {
+		http.Error(w, "result.json not found in import folder", http.StatusBadRequest)
+		return
+	}
+
+	var export TelegramExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		log.Printf("Failed to decode Telegram export: %v\n", err)
+		http.Error(w, "Invalid result.json", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// One import per channel at a time, the lock outlives a crashed one
+	channelId := channelIdFromRequest(r)
+	locked, err := rdb.SetNX(ctx, telegramImportLockKey(channelId), req.Folder, telegramImportTimeout).Result()
+	if err != nil {
+		http.Error(w, "Failed to start import", http.StatusInternalServerError)
+		return
+	}
+	if !locked {
+		http.Error(w, "An import is already running", http.StatusConflict)
+		return
+	}
+
+	status := TelegramImportStatus{
+		Status:    TelegramImportRunning,
+		Folder:    req.Folder,
+		StartedAt: time.Now(),
+	}
+	if err := dbSetTelegramImportStatus(ctx, channelId, status); err != nil {
+		rdb.Del(ctx, telegramImportLockKey(channelId))
+		http.Error(w, "Failed to start import", http.StatusInternalServerError)
+		return
+	}
+
+	go runTelegramImportJob(channelId, exportDir, export, status)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+// runTelegramImportJob runs an import in the background and records its
+// outcome in the channel's import status.
+func runTelegramImportJob(channelId int, exportDir string, export TelegramExport, status TelegramImportStatus) {
+	ctx, cancel := context.WithTimeout(context.Background(), telegramImportTimeout)
+	defer cancel()
+
+	result, err := runTelegramImport(ctx, channelId, exportDir, export)
+	status.TelegramImportResult = result
+	status.FinishedAt = time.Now()
+	status.Status = TelegramImportDone
+	if err != nil {
+		log.Printf("Failed to import Telegram export: %v\n", err)
+		status.Status = TelegramImportFailed
+		status.Error = "Failed to import Telegram export"
+	} else {
+		log.Printf("Telegram import of %q: %d imported, %d skipped, %d failed\n", status.Folder, result.Imported, result.Skipped, result.Failed)
+	}
+
+	// The import's own time may be up, the outcome is saved regardless
+	saveCtx, saveCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer saveCancel()
+
+	if err := dbSetTelegramImportStatus(saveCtx, channelId, status); err != nil {
+		log.Printf("Failed to save Telegram import status: %v\n", err)
+	}
+	rdb.Del(saveCtx, telegramImportLockKey(channelId))
+}
+
+func getTelegramImportStatus(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	status, err := dbGetTelegramImportStatus(ctx, channelIdFromRequest(r))
+	if err != nil {
+		if err == redis.Nil {
+			http.Error(w, "No import has run", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to get import status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// runTelegramImport creates a message in the channel for every message of the
+// export that was not imported into it before. The mapping from Telegram
+// message ids to our ids is kept in Redis, so running the same import again
+// skips what exists and lets replies point at messages imported in an
+// earlier run.
+//
+// Imported messages are historical, so they are created as silent posts,
+// without a webhook or push notification.
+func runTelegramImport(ctx context.Context, channelId int, exportDir string, export TelegramExport) (TelegramImportResult, error) {
+	var result TelegramImportResult
+	mappingKey := fmt.Sprintf("import:telegram:%d:%d", channelId, export.ID)
+
+	mapping, err := rdb.HGetAll(ctx, mappingKey).Result()
+	if err != nil {
+		return result, err
+	}
+
+	for _, tm := range export.Messages {
+		if tm.Type != "message" {
+			continue
+		}
+
+		tmId := strconv.Itoa(tm.ID)
+		reservedId, reserved := mapping[tmId]
+		if reserved {
+			exists, err := rdb.Exists(ctx, "messages:"+reservedId).Result()
+			if err != nil {
+				return result, err
+			}
+			// Purged messages are not imported again
+			purged, err := rdb.SIsMember(ctx, purgedKey(channelId), reservedId).Result()
+			if err != nil {
+				return result, err
+			}
+			if exists > 0 || purged {
+				result.Skipped++
+				continue
+			}
+		}
+
+		message, err := convertTelegramMessage(exportDir, export, tm, mapping)
+		if err != nil {
+			log.Printf("Failed to convert Telegram message %d: %v\n", tm.ID, err)
+			result.Failed++
+			continue
+		}
+
+		// The mapping entry is reserved before the message is saved, so a
+		// run that stops in between doesn't import it twice. The next run
+		// finds the reserved id without a message and saves it under that id.
+		if reserved {
+			message.ID, _ = strconv.Atoi(reservedId)
+		} else {
+			message.ID = getMessageNextId(ctx)
+			claimed, err := rdb.HSetNX(ctx, mappingKey, tmId, message.ID).Result()
+			if err != nil {
+				return result, err
+			}
+			if !claimed {
+				// Another run of the same import got to it first
+				result.Skipped++
+				continue
+			}
+			mapping[tmId] = strconv.Itoa(message.ID)
+		}
+
+		_, err = createPost(ctx, NewPost{
+			ID:        message.ID,
+			ChannelId: channelId,
+			Source:    PostSourceImport,
+			Author:    message.Author,
+			Type:      message.Type,
+			Text:      message.Text,
+			ReplyTo:   message.ReplyTo,
+			Timestamp: message.Timestamp,
+			LastEdit:  message.LastEdit,
+			Silent:    true,
+		})
+		if err != nil {
+			var pe *postError
+			if !errors.As(err, &pe) {
+				return result, err
+			}
+			log.Printf("Failed to import Telegram message %d: %v\n", tm.ID, err)
+			result.Failed++
+			continue
+		}
+		result.Imported++
+	}
+
+	return result, nil
+}
+
+func convertTelegramMessage(exportDir string, export TelegramExport, tm TelegramMessage, mapping map[string]string) (Message, error) {
+	var message Message
+
+	timestamp, err := parseTelegramTime(tm.DateUnixtime, tm.Date)
+	if err != nil {
+		return message, err
+	}
+
+	message.Type = "md"
+	message.Timestamp = timestamp
+	message.Author = tm.From
+	if message.Author == "" {
+		message.Author = export.Name
+	}
+
+	if tm.EditedUnixtime != "" {
+		if edited, err := parseTelegramTime(tm.EditedUnixtime, ""); err == nil {
+			message.LastEdit = edited
+		}
+	}
+
+	entities := tm.TextEntities
+	if entities == nil {
+		entities = parseTelegramText(tm.Text)
+	}
+	message.Text = telegramEntitiesToMarkdown(entities)
+
+	if tm.ReplyToMessageID > 0 {
+		if replyTo, err := strconv.Atoi(mapping[strconv.Itoa(tm.ReplyToMessageID)]); err == nil {
+			message.ReplyTo = replyTo
+		}
+	}
+
+	for _, mediaPath := range []string{tm.Photo, tm.File} {
+		if mediaPath == "" {
+			continue
+		}
+
+		file, err := importTelegramMedia(exportDir, mediaPath)
+		if err != nil {
+			// Exports made without media keep a placeholder instead of the path
+			log.Printf("Skipping media %q of Telegram message %d: %v\n", mediaPath, tm.ID, err)
+			continue
+		}
+		message.Text = embedFileInText(message.Text, file)
+	}
+
+	if message.Text == "" {
+		return message, errors.New("message has no text or media")
+	}
+
+	return message, nil
+}
+
+func importTelegramMedia(exportDir, mediaPath string) (FileResponse, error) {
+	fullPath, err := resolveImportPath(exportDir, mediaPath)
+	if err != nil {
+		return FileResponse{}, err
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return FileResponse{}, err
+	}
+	defer file.Close()
+
+	return processAndSaveFile(file, &multipart.FileHeader{Filename: filepath.Base(fullPath)})
+}
+
+// resolveImportPath joins a relative path to base and rejects paths that
+// would leave it.
+func resolveImportPath(base, rel string) (string, error) {
+	fullPath := filepath.Join(base, rel)
+	relPath, err := filepath.Rel(base, fullPath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", errors.New("path is outside of the import folder")
+	}
+	return fullPath, nil
+}
+
+func parseTelegramTime(unixtime, date string) (time.Time, error) {
+	if unixtime != "" {
+		seconds, err := strconv.ParseInt(unixtime, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(seconds, 0), nil
+	}
+
+	return time.ParseInLocation("2006-01-02T15:04:05", date, time.Local)
+}
+
+// parseTelegramText reads the "text" field of older exports, which is either
+// a plain string or a list of strings and entities.
+func parseTelegramText(raw json.RawMessage) []TelegramEntity {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []TelegramEntity{{Type: "plain", Text: text}}
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil
+	}
+
+	entities := make([]TelegramEntity, 0, len(parts))
+	for _, part := range parts {
+		var entity TelegramEntity
+		if err := json.Unmarshal(part, &text); err == nil {
+			entity = TelegramEntity{Type: "plain", Text: text}
+		} else if err := json.Unmarshal(part, &entity); err != nil {
+			continue
+		}
+		entities = append(entities, entity)
+	}
+
+	return entities
+}
+
+func telegramEntitiesToMarkdown(entities []TelegramEntity) string {
+	var sb strings.Builder
+
+	for _, e := range entities {
+		switch e.Type {
+		case "bold":
+			sb.WriteString(wrapMarkdown(e.Text, "**"))
+		case "italic":
+			sb.WriteString(wrapMarkdown(e.Text, "*"))
+		case "strikethrough":
+			sb.WriteString(wrapMarkdown(e.Text, "~~"))
+		case "code":
+			sb.WriteString(wrapMarkdown(e.Text, "`"))
+		case "pre":
+			sb.WriteString("```" + e.Language + "\n" + e.Text + "\n```")
+		case "text_link":
+			sb.WriteString("[" + e.Text + "](" + e.Href + ")")
+		case "blockquote":
+			sb.WriteString("> " + strings.ReplaceAll(e.Text, "\n", "\n> "))
+		default:
+			// plain, link, mention, hashtag, spoiler, underline etc. keep their text
+			sb.WriteString(e.Text)
+		}
+	}
+
+	return sb.String()
+}
+
+// wrapMarkdown surrounds text with a markdown marker, keeping surrounding
+// whitespace outside of it so that "**bold **" does not break rendering.
+func wrapMarkdown(text, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+
+	start := strings.Index(text, trimmed)
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type TrashResponse struct {
+	Messages []Message `json:"messages"`
+	Total    int64     `json:"total"`
+}
+
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	messages, total, err := dbGetDeletedMessages(ctx, channelIdFromRequest(r), offset, limit)
+	if err != nil {
+		log.Printf("Failed to get deleted messages: %v\n", err)
+		http.Error(w, "Failed to get deleted messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TrashResponse{Messages: messages, Total: total})
+}
+
+func purgeMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var req struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	deleted, err := rdb.HGet(ctx, fmt.Sprintf("messages:%d", req.ID), "deleted").Result()
+	if err != nil || !messageInChannel(ctx, r, req.ID) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	if deleted != "1" {
+		http.Error(w, "Only deleted messages can be purged", http.StatusBadRequest)
+		return
+	}
+
+	fileIds, err := dbPurgeMessage(ctx, req.ID)
+	if err != nil {
+		log.Printf("Failed to purge message %d: %v\n", req.ID, err)
+		http.Error(w, "Failed to purge message", http.StatusInternalServerError)
+		return
+	}
+
+	if err := purgeFiles(fileIds); err != nil {
+		log.Printf("Failed to purge files of message %d: %v\n", req.ID, err)
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func restoreMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var req struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	deleted, err := rdb.HGet(ctx, fmt.Sprintf("messages:%d", req.ID), "deleted").Result()
+	if err != nil || !messageInChannel(ctx, r, req.ID) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	if deleted != "1" {
+		http.Error(w, "Message is not deleted", http.StatusBadRequest)
+		return
+	}
+
+	// Expired messages lost their files and reactions, they stay deleted
+	if expiredByRetention(ctx, channelIdFromRequest(r), req.ID) {
+		http.Error(w, "Message expired by the retention policy", http.StatusBadRequest)
+		return
+	}
+
+	message, err := dbRestoreMessage(ctx, req.ID)
+	if err != nil {
+		log.Printf("Failed to restore message %d: %v\n", req.ID, err)
+		http.Error(w, "Failed to restore message", http.StatusInternalServerError)
+		return
+	}
+
+	publishEvent(ctx, "restore-message", message)
+	go SendWebhook(context.Background(), "restore", message)
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
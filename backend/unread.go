@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The last-read position of every user is kept in the last_read:{channelId}
+// hash as a MessageCursor, so it stays valid after the message it points to
+// is deleted. Positions follow the same (score, id) order as the cursors.
+
+type UnreadStatus struct {
+	LastReadId    int   `json:"lastReadId"`
+	FirstUnreadId int   `json:"firstUnreadId"`
+	UnreadCount   int64 `json:"unreadCount"`
+}
+
+func dbGetLastRead(ctx context.Context, channelId int, userId string) (*MessageCursor, error) {
+	value, err := rdb.HGet(ctx, lastReadKey(channelId), userId).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var position MessageCursor
+	if err := json.Unmarshal([]byte(value), &position); err != nil {
+		return nil, nil
+	}
+	return &position, nil
+}
+
+// advanceLastReadScript saves a last-read position only when it is after the
+// stored one, in one step, so concurrent tabs can't move it back.
+var advanceLastReadScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], ARGV[1])
+if current then
+	local ok, position = pcall(cjson.decode, current)
+	if ok and type(position) == 'table' and tonumber(position['s']) then
+		local score = tonumber(ARGV[2])
+		local id = tonumber(ARGV[3])
+		local currentScore = tonumber(position['s'])
+		local currentId = tonumber(position['i']) or 0
+		if score < currentScore or (score == currentScore and id <= currentId) then
+			return 0
+		end
+	end
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[4])
+return 1
+`)
+
+// dbAdvanceLastRead moves the user's last-read position forward to position.
+// An older position leaves the stored one as it is.
+func dbAdvanceLastRead(ctx context.Context, channelId int, userId string, position MessageCursor) error {
+	data, err := json.Marshal(MessageCursor{Score: position.Score, ID: position.ID})
+	if err != nil {
+		return err
+	}
+	return advanceLastReadScript.Run(ctx, rdb, []string{lastReadKey(channelId)},
+		userId, strconv.FormatFloat(position.Score, 'f', -1, 64), position.ID, data).Err()
+}
+
+// unreadStatusScript counts the messages of a time set after a last-read
+// position, in the (score, id) order of the cursors, and finds the first of
+// them. Like the range scripts it leaves out deleted messages and thread
+// replies, which readers don't see in the channel. Without a position, in
+// ARGV[1], every message is after it.
+var unreadStatusScript = redis.NewScript(`
+local min = '-inf'
+local lastScore = tonumber(ARGV[1])
+local lastId = tonumber(ARGV[2]) or 0
+if lastScore then
+	min = ARGV[1]
+end
+
+local count = 0
+local firstId = 0
+local firstScore = nil
+
+local entries = redis.call('ZRANGEBYSCORE', KEYS[1], min, '+inf', 'WITHSCORES')
+for i = 1, #entries, 2 do
+	local messageKey = entries[i]
+	local score = tonumber(entries[i + 1])
+	local id = tonumber(string.match(messageKey, '%d+'))
+
+	if id and not (lastScore and score == lastScore and id <= lastId) then
+		local values = redis.call('HMGET', messageKey, 'id', 'deleted', 'is_thread', 'reply_to')
+		local replyTo = tonumber(values[4]) or 0
+		local isReply = values[3] == '1' and replyTo > 0
+
+		if values[1] and values[2] ~= '1' and not isReply then
+			count = count + 1
+			if firstScore == nil or score < firstScore or (score == firstScore and id < firstId) then
+				firstScore = score
+				firstId = id
+			end
+		end
+	end
+end
+
+return {count, firstId}
+`)
+
+// dbGetUnreadStatus counts the visible messages of the channel after the
+// user's last-read position. Without a position every message is unread.
+func dbGetUnreadStatus(ctx context.Context, channelId int, userId string) (UnreadStatus, error) {
+	var status UnreadStatus
+
+	position, err := dbGetLastRead(ctx, channelId, userId)
+	if err != nil {
+		return status, err
+	}
+
+	args := []interface{}{"", 0}
+	if position != nil {
+		status.LastReadId = position.ID
+		args = []interface{}{strconv.FormatFloat(position.Score, 'f', -1, 64), position.ID}
+	}
+
+	result, err := unreadStatusScript.Run(ctx, rdb, []string{timesKey(channelId)}, args...).Int64Slice()
+	if err != nil {
+		return status, err
+	}
+	if len(result) == 2 {
+		status.UnreadCount = result[0]
+		status.FirstUnreadId = int(result[1])
+	}
+
+	return status, nil
+}
+
+func getUnreadStatus(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	status, err := dbGetUnreadStatus(ctx, channelIdFromRequest(r), user.ID)
+	if err != nil {
+		http.Error(w, "Failed to get unread status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// markRead moves the user's last-read position to a message. The position
+// only moves forward, so an older tab cannot undo a newer one.
+func markRead(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user := session.Values["user"].(Session)
+
+	var req struct {
+		MessageID int `json:"messageId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	channelId := channelIdFromRequest(r)
+	if !messageInChannel(ctx, r, req.MessageID) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	score, err := rdb.ZScore(ctx, timesKey(channelId), fmt.Sprintf("messages:%d", req.MessageID)).Result()
+	if err != nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	position := MessageCursor{Score: score, ID: req.MessageID}
+
+	if err := dbAdvanceLastRead(ctx, channelId, user.ID, position); err != nil {
+		http.Error(w, "Failed to set last read message", http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}